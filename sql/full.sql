@@ -15,7 +15,9 @@ CREATE TABLE IF NOT EXISTS `traces` (
   `service_name` varchar(128) DEFAULT NULL,
   `http_code` int(11) DEFAULT 0,
   `error`  tinyint(1) DEFAULT 0,
+  `span_kind` varchar(16) NOT NULL DEFAULT '',
   PRIMARY KEY (`id`),
+  UNIQUE KEY `uk_trace_span_hash` (`trace_id`,`span_hash`),
   KEY `idx_trace_id` (`trace_id`),
   KEY `idx_service_name` (`service_name`),
   KEY `idx_operation_name` (`operation_name`),
@@ -29,12 +31,45 @@ CREATE TABLE IF NOT EXISTS `traces` (
 CREATE TABLE IF NOT EXISTS `operation_names` (
   `service_name` varchar(128) NOT NULL,
   `operation_name` varchar(128) NOT NULL,
-  PRIMARY KEY (`service_name`,`operation_name`)
+  `span_kind` varchar(16) NOT NULL DEFAULT '',
+  `first_seen` bigint(20) NOT NULL DEFAULT 0,
+  `last_seen` bigint(20) NOT NULL DEFAULT 0,
+  `span_count` bigint(20) NOT NULL DEFAULT 0,
+  PRIMARY KEY (`service_name`,`operation_name`,`span_kind`),
+  KEY `last_seen` (`last_seen`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
 
 CREATE TABLE IF NOT EXISTS `service_names` (
   `service_name` varchar(128) NOT NULL,
+  `first_seen` bigint(20) NOT NULL DEFAULT 0,
+  `last_seen` bigint(20) NOT NULL DEFAULT 0,
+  `span_count` bigint(20) NOT NULL DEFAULT 0,
   PRIMARY KEY (`service_name`),
+  KEY `last_seen` (`last_seen`),
   UNIQUE KEY `service_name` (`service_name`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+
+CREATE TABLE IF NOT EXISTS `span_tags` (
+  `trace_id` varchar(100) NOT NULL,
+  `span_hash` bigint(20) NOT NULL,
+  `tag_key` varchar(128) NOT NULL,
+  `tag_value` varchar(255) NOT NULL,
+  `start_time` bigint(20) NOT NULL,
+  PRIMARY KEY (`trace_id`,`span_hash`,`tag_key`,`tag_value`),
+  KEY `idx_tag_time` (`tag_key`,`tag_value`,`start_time`),
+  KEY `idx_start_time` (`start_time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+
+CREATE TABLE IF NOT EXISTS `traces_dead_letter` (
+  `id`         INT(11) NOT NULL AUTO_INCREMENT,
+  `created_at` bigint(20) NOT NULL,
+  `error_code` int(11) DEFAULT 0,
+  `error`      text,
+  `span_count` int(11) DEFAULT 0,
+  `batch`      longtext,
+  PRIMARY KEY (`id`),
+  KEY `idx_created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
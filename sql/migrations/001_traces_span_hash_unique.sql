@@ -0,0 +1,8 @@
+-- Make (trace_id, span_hash) unique so that replayed and retried spans are stored once.
+-- Run it before enabling mysql.idempotentWrites on a database created from an older full.sql.
+
+-- remove the duplicated rows, the oldest copy of every span is kept
+DELETE t1 FROM `traces` t1
+  JOIN `traces` t2 ON t1.`trace_id` = t2.`trace_id` AND t1.`span_hash` = t2.`span_hash` AND t1.`id` > t2.`id`;
+
+ALTER TABLE `traces` ADD UNIQUE KEY `uk_trace_span_hash` (`trace_id`,`span_hash`);
@@ -0,0 +1,20 @@
+-- Store the span.kind tag so that the operations can be filtered by span kind (server, client, producer, consumer).
+-- Run it before upgrading the plugin on a database created from an older full.sql.
+
+ALTER TABLE `traces` ADD COLUMN `span_kind` varchar(16) NOT NULL DEFAULT '';
+
+ALTER TABLE `operation_names`
+  ADD COLUMN `span_kind` varchar(16) NOT NULL DEFAULT '',
+  DROP PRIMARY KEY,
+  ADD PRIMARY KEY (`service_name`,`operation_name`,`span_kind`);
+
+-- backfill the stored spans from their tags, e.g. [{"key":"span.kind","v_str":"server"}].
+-- It rewrites the whole traces table, skip it on a big table: the old spans then keep an empty span kind
+-- and their operations are still listed when no span kind is asked for.
+UPDATE `traces`
+  SET `span_kind` = JSON_UNQUOTE(JSON_EXTRACT(`tags`,
+    REPLACE(JSON_UNQUOTE(JSON_SEARCH(`tags`, 'one', 'span.kind', NULL, '$[*].key')), '.key', '.v_str')))
+  WHERE JSON_SEARCH(`tags`, 'one', 'span.kind', NULL, '$[*].key') IS NOT NULL;
+
+INSERT IGNORE INTO `operation_names` (`service_name`, `operation_name`, `span_kind`)
+  SELECT DISTINCT `service_name`, `operation_name`, `span_kind` FROM `traces` WHERE `span_kind` <> '';
@@ -0,0 +1,29 @@
+-- Record when each service and operation was first and last seen (microseconds, like traces.start_time)
+-- and how many spans they had. The entries not seen for `expired` days are hidden and pruned.
+-- Run it before upgrading the plugin on a database created from an older full.sql.
+
+ALTER TABLE `service_names`
+  ADD COLUMN `first_seen` bigint(20) NOT NULL DEFAULT 0,
+  ADD COLUMN `last_seen` bigint(20) NOT NULL DEFAULT 0,
+  ADD COLUMN `span_count` bigint(20) NOT NULL DEFAULT 0,
+  ADD KEY `last_seen` (`last_seen`);
+
+ALTER TABLE `operation_names`
+  ADD COLUMN `first_seen` bigint(20) NOT NULL DEFAULT 0,
+  ADD COLUMN `last_seen` bigint(20) NOT NULL DEFAULT 0,
+  ADD COLUMN `span_count` bigint(20) NOT NULL DEFAULT 0,
+  ADD KEY `last_seen` (`last_seen`);
+
+-- backfill from the stored spans, otherwise the existing entries stay hidden until they are seen again
+UPDATE `service_names` s JOIN (
+    SELECT `service_name`, MIN(`start_time`) AS first_seen, MAX(`start_time`) AS last_seen, COUNT(*) AS span_count
+    FROM `traces` GROUP BY `service_name`
+  ) t ON s.`service_name` = t.`service_name`
+  SET s.`first_seen` = t.first_seen, s.`last_seen` = t.last_seen, s.`span_count` = t.span_count;
+
+UPDATE `operation_names` o JOIN (
+    SELECT `service_name`, `operation_name`, `span_kind`,
+      MIN(`start_time`) AS first_seen, MAX(`start_time`) AS last_seen, COUNT(*) AS span_count
+    FROM `traces` GROUP BY `service_name`, `operation_name`, `span_kind`
+  ) t ON o.`service_name` = t.`service_name` AND o.`operation_name` = t.`operation_name` AND o.`span_kind` = t.`span_kind`
+  SET o.`first_seen` = t.first_seen, o.`last_seen` = t.last_seen, o.`span_count` = t.span_count;
@@ -0,0 +1,13 @@
+-- Index the span and process tags so that FindTraceIDs can search any tag, written when mysql.tagIndex is on.
+-- Only the spans written after the upgrade are indexed.
+
+CREATE TABLE IF NOT EXISTS `span_tags` (
+  `trace_id` varchar(100) NOT NULL,
+  `span_hash` bigint(20) NOT NULL,
+  `tag_key` varchar(128) NOT NULL,
+  `tag_value` varchar(255) NOT NULL,
+  `start_time` bigint(20) NOT NULL,
+  PRIMARY KEY (`trace_id`,`span_hash`,`tag_key`,`tag_value`),
+  KEY `idx_tag_time` (`tag_key`,`tag_value`,`start_time`),
+  KEY `idx_start_time` (`start_time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,12 @@
+-- Move a mysql >= 8.0.17 database created from sql/full.sql to the sql/full_mysql8.sql schema, then set
+-- mysql.schema=json. It rewrites the whole traces table and fails on the rows whose tags, logs or process
+-- are not valid JSON. Stay on the text schema for mysql 5.7.
+
+ALTER TABLE `traces`
+  MODIFY COLUMN `tags` json,
+  MODIFY COLUMN `logs` json,
+  MODIFY COLUMN `process` json,
+  ADD COLUMN `tag_keys` json GENERATED ALWAYS AS (JSON_MERGE_PRESERVE(
+    IFNULL(JSON_EXTRACT(`tags`, '$[*].key'), JSON_ARRAY()),
+    IFNULL(JSON_EXTRACT(`process`, '$.tags[*].key'), JSON_ARRAY()))) STORED,
+  ADD KEY `idx_tag_keys` ((CAST(`tag_keys` AS CHAR(255) ARRAY)));
@@ -0,0 +1,8 @@
+-- Full-text search of the tag and log values, needed by mysql.fullText. Query with the _text tag,
+-- e.g. _text=connection refused matches the spans holding these words in that order.
+-- The default parser splits on spaces and punctuation; for Chinese or Japanese text add WITH PARSER ngram.
+-- Only the spans written after the upgrade are searchable.
+
+ALTER TABLE `traces`
+  ADD COLUMN `search_text` mediumtext,
+  ADD FULLTEXT KEY `ft_search_text` (`search_text`);
@@ -0,0 +1,13 @@
+-- Dead letter table of the batches that could not be stored, needed by mysql.deadLetter=table.
+-- Replay them with the admin replay-dead-letter command once the cause is fixed.
+
+CREATE TABLE IF NOT EXISTS `traces_dead_letter` (
+  `id`         INT(11) NOT NULL AUTO_INCREMENT,
+  `created_at` bigint(20) NOT NULL,
+  `error_code` int(11) DEFAULT 0,
+  `error`      text,
+  `span_count` int(11) DEFAULT 0,
+  `batch`      longtext,
+  PRIMARY KEY (`id`),
+  KEY `idx_created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
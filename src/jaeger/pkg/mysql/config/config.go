@@ -28,4 +28,95 @@ type Configuration struct {
 	Workers     int       `yaml:"workers"`
 	Expired     int       `yaml:"expired"`
 	Interval    int       `yaml:"interval"`
+	// SpillDir enables the on-disk overflow queue when not empty
+	SpillDir         string `yaml:"spillDir"`
+	SpillMaxSize     int    `yaml:"spillMaxSize"`
+	SpillSegmentSize int    `yaml:"spillSegmentSize"`
+	// RetryBackoff and RetryMaxBackoff are in milliseconds
+	RetryAttempts   int `yaml:"retryAttempts"`
+	RetryBackoff    int `yaml:"retryBackoff"`
+	RetryMaxBackoff int `yaml:"retryMaxBackoff"`
+	// DeadLetter is the sink of the batches that failed after all retries: "table", "file" or empty to drop them
+	DeadLetter     string `yaml:"deadLetter"`
+	DeadLetterFile string `yaml:"deadLetterFile"`
+	// ShutdownTimeout is how long Close waits for the pending spans to be flushed, in seconds
+	ShutdownTimeout int `yaml:"shutdownTimeout"`
+	// WriteMode is one of async-drop, async-block or sync, WriteTimeout is in milliseconds
+	WriteMode         string `yaml:"write-mode"`
+	WriteTimeout      int    `yaml:"write-timeout"`
+	WriteSyncBatching bool   `yaml:"write-sync-batching"`
+	// IdempotentWrites skips the spans already stored, it relies on the (trace_id, span_hash) unique key
+	IdempotentWrites bool `yaml:"idempotentWrites"`
+	// TraceAffinity shards the queue by trace id so the spans of a trace are batched by the same worker
+	TraceAffinity bool `yaml:"traceAffinity"`
+	// Adaptive tunes batchsize, lingerTime and the number of active workers at runtime within the bounds below,
+	// TargetLatency is in milliseconds
+	Adaptive      bool `yaml:"adaptive"`
+	MinBatchsize  int  `yaml:"minBatchsize"`
+	MaxBatchsize  int  `yaml:"maxBatchsize"`
+	MinWorkers    int  `yaml:"minWorkers"`
+	MaxWorkers    int  `yaml:"maxWorkers"`
+	TargetLatency int  `yaml:"targetLatency"`
+	// InsertMethod is insert or load-data, load-data needs local_infile=ON on the server
+	InsertMethod string `yaml:"insertMethod"`
+	// PriorityQueue puts error, 5xx and debug spans in a lane of their own in front of the queue,
+	// OverflowPolicy is drop-newest, drop-oldest or drop-lowest-priority
+	PriorityQueue      bool   `yaml:"priorityQueue"`
+	PriorityLaneLength int    `yaml:"priorityLaneLength"`
+	NormalLaneLength   int    `yaml:"normalLaneLength"`
+	OverflowPolicy     string `yaml:"overflowPolicy"`
+	// RateLimit is the default limit of every service in spans per second, 0 for none,
+	// RateLimits overrides it for some services
+	RateLimit      float64              `yaml:"rateLimit"`
+	RateLimitBurst int                  `yaml:"rateLimitBurst"`
+	RateLimits     map[string]RateLimit `yaml:"rateLimits"`
+	// SamplingRules is the path of the write-time sampling rules file, empty to store every span
+	SamplingRules string `yaml:"samplingRules"`
+	// TailSampling buffers the spans of a trace for TailDecisionWait milliseconds and only stores the traces
+	// with an error, a 5xx, a root span lasting TailRootDuration milliseconds or one of TailTags
+	TailSampling     bool     `yaml:"tailSampling"`
+	TailDecisionWait int      `yaml:"tailDecisionWait"`
+	TailMaxSpans     int      `yaml:"tailMaxSpans"`
+	TailRootDuration int      `yaml:"tailRootDuration"`
+	TailTags         []string `yaml:"tailTags"`
+	// MaxOperationsPerService caps the operations of a service, 0 for no cap. The new operations
+	// beyond it are stored as OverflowOperationName.
+	MaxOperationsPerService int    `yaml:"maxOperationsPerService"`
+	OverflowOperationName   string `yaml:"overflowOperationName"`
+	// OperationRules normalize the operation names, e.g. /users/8812 into /users/{id}
+	OperationRules []OperationRule `yaml:"operationRules"`
+	// ServiceAliases map the old names of the renamed services to their canonical name
+	ServiceAliases []ServiceAlias `yaml:"serviceAliases"`
+	// TagIndex writes the span and process tags to span_tags so that any tag can be searched,
+	// only the keys of TagIndexAllow if not empty, never the keys of TagIndexDeny
+	TagIndex      bool     `yaml:"tagIndex"`
+	TagIndexAllow []string `yaml:"tagIndexAllow"`
+	TagIndexDeny  []string `yaml:"tagIndexDeny"`
+	// PromotedTags are written to a traces column of their own, tag_<key>, and searched on it
+	PromotedTags []string `yaml:"promotedTags"`
+	// Schema is text for sql/full.sql or json for sql/full_mysql8.sql, which searches the tags in the JSON columns
+	Schema string `yaml:"schema"`
+	// FullText writes the tag and log values to the search_text column, searched with the _text tag
+	FullText bool `yaml:"fullText"`
+}
+
+// RateLimit is the rate limit of a service, Operations limits some of its operations on top of it
+type RateLimit struct {
+	Rate       float64              `yaml:"rate" mapstructure:"rate"`
+	Burst      int                  `yaml:"burst" mapstructure:"burst"`
+	Operations map[string]RateLimit `yaml:"operations" mapstructure:"operations"`
+}
+
+// ServiceAlias is an old name of a service, Canonical is the name it is written and searched under
+type ServiceAlias struct {
+	Name      string `yaml:"name" mapstructure:"name"`
+	Canonical string `yaml:"canonical" mapstructure:"canonical"`
+}
+
+// OperationRule rewrites the operation names of Service, or of every service when empty,
+// matching the Pattern regexp into Replacement, which may refer to the groups of the pattern
+type OperationRule struct {
+	Service     string `yaml:"service" mapstructure:"service"`
+	Pattern     string `yaml:"pattern" mapstructure:"pattern"`
+	Replacement string `yaml:"replacement" mapstructure:"replacement"`
 }
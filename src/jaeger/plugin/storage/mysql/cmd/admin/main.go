@@ -0,0 +1,155 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// admin runs the maintenance operations of the mysql storage plugin
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/uber/jaeger-lib/metrics"
+	"go.uber.org/zap"
+
+	mSpanStore "github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore"
+)
+
+const usage = `usage: admin [flags] <command>
+
+commands:
+  replay-dead-letter   insert the batches kept by the dead letter sink back into the traces table
+  rewrite-aliases      move the spans, operations and usage stored under the old service names of -aliases
+                       to their canonical name
+  promote-tags         print the traces columns missing for the -promoted-tags, or add them with -apply
+
+flags:
+`
+
+func main() {
+	var (
+		url            = flag.String("url", "", "The mysql url, e.g. root:111111@tcp(127.0.0.1:3306)/go?charset=utf8")
+		deadLetter     = flag.String("dead-letter", mSpanStore.DeadLetterTable, "The dead letter sink to replay: table or file")
+		deadLetterFile = flag.String("dead-letter-file", "", "The dead letter file path when -dead-letter is file, or the fallback file of the table (default traces_dead_letter.json)")
+		retryAttempts  = flag.Int("retry-attempts", 3, "The max attempts of one batch insert")
+		idempotent     = flag.Bool("idempotent", true, "Skip the spans already stored, requires the (trace_id, span_hash) unique key")
+		aliases        = flag.String("aliases", "", "The comma separated service aliases to rewrite, old=canonical")
+		batchSize      = flag.Int("batch-size", 1000, "The max spans updated by one statement")
+		promotedTags   = flag.String("promoted-tags", "", "The comma separated promoted tag keys, as mysql.promotedTags, replayed to their columns")
+		apply          = flag.Bool("apply", false, "Run the migration instead of printing it")
+		fullText       = flag.Bool("full-text", false, "Replay the search_text column too, as mysql.fullText")
+	)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *url == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	db, err := sql.Open("mysql", *url)
+	if err != nil {
+		logger.Fatal("Cannot create mysql session", zap.Error(err))
+	}
+	defer db.Close()
+
+	switch flag.Arg(0) {
+	case "replay-dead-letter":
+		sink, err := mSpanStore.NewDeadLetterSink(*deadLetter, db, *deadLetterFile)
+		if err != nil {
+			logger.Fatal("Cannot create dead letter sink", zap.Error(err))
+		}
+		var promoted *mSpanStore.PromotedTags
+		if keys := splitList(*promotedTags); len(keys) > 0 {
+			promoted, err = mSpanStore.NewPromotedTags(keys)
+			if err != nil {
+				logger.Fatal("Cannot name the promoted tag columns", zap.Error(err))
+			}
+		}
+		backgroudMetrics := mSpanStore.NewBackgroudMetrics(metrics.NullCounter, metrics.NullCounter, metrics.NullCounter,
+			metrics.NullCounter, nil, nil, metrics.NullCounter, metrics.NullGauge, metrics.NullGauge, metrics.NullGauge)
+		store := mSpanStore.NewBackgroudStore(db, nil, nil, nil, mSpanStore.NewRetryPolicy(*retryAttempts, 100, 5000), sink,
+			logger, mSpanStore.BackgroudOptions{Idempotent: *idempotent, Promoted: promoted, FullText: *fullText}, backgroudMetrics)
+		replayed, err := store.ReplayDeadLetters()
+		if err != nil {
+			logger.Fatal("replay dead letters error", zap.Error(err), zap.Int("replayed", replayed))
+		}
+		logger.Info("replay dead letters success", zap.Int("replayed", replayed))
+	case "rewrite-aliases":
+		aliasMap := map[string]string{}
+		for _, alias := range strings.Split(*aliases, ",") {
+			parts := strings.SplitN(strings.TrimSpace(alias), "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				logger.Fatal("invalid service alias, expected old=canonical", zap.String("alias", alias))
+			}
+			aliasMap[parts[0]] = parts[1]
+		}
+		serviceAliases, err := mSpanStore.NewServiceAliases(aliasMap)
+		if err != nil {
+			logger.Fatal("Cannot resolve service aliases", zap.Error(err))
+		}
+		rewritten, err := serviceAliases.RewriteHistory(db, *batchSize, logger)
+		if err != nil {
+			logger.Fatal("rewrite service aliases error", zap.Error(err), zap.Int64("rewritten", rewritten))
+		}
+		logger.Info("rewrite service aliases success", zap.Int64("rewritten", rewritten))
+	case "promote-tags":
+		promoted, err := mSpanStore.NewPromotedTags(splitList(*promotedTags))
+		if err != nil {
+			logger.Fatal("Cannot name the promoted tag columns", zap.Error(err))
+		}
+		missing, err := promoted.MissingColumns(db)
+		if err != nil {
+			logger.Fatal("Cannot read the traces columns", zap.Error(err))
+		}
+		if len(missing) == 0 {
+			logger.Info("the promoted tag columns are up to date")
+			return
+		}
+		migration := promoted.MigrationSQL(missing)
+		if !*apply {
+			fmt.Print(migration)
+			return
+		}
+		// adding the columns rebuilds the traces table, it may take a while on a big one
+		if _, err := db.Exec(migration); err != nil {
+			logger.Fatal("add promoted tag columns error", zap.Error(err))
+		}
+		logger.Info("add promoted tag columns success", zap.Strings("tags", missing))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// splitList splits a comma separated flag, the empty items are skipped
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"database/sql"
 	"flag"
+	"strconv"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -36,6 +37,29 @@ import (
 const (
 	SpanDropCountName         = "mysql_span_drop_count"
 	MysqlBatchInsertErrorName = "mysql_batch_insert_error_count"
+	SpanSpillCountName        = "mysql_span_spill_count"
+	SpanReplayCountName       = "mysql_span_replay_count"
+	SpanSpillDiscardCountName = "mysql_span_spill_discard_count"
+	MysqlBatchInsertRetryName = "mysql_batch_insert_retry_count"
+	DeadLetterSpanCountName   = "mysql_dead_letter_span_count"
+	DeadLetterErrorName       = "mysql_dead_letter_error_count"
+	SpanRejectedCountName     = "mysql_span_rejected_count"
+	WorkerQueueDepthName      = "mysql_worker_queue_depth"
+	AffinityRerouteCountName  = "mysql_affinity_reroute_count"
+	BatchSizeName             = "mysql_batch_size"
+	LingerTimeName            = "mysql_linger_time_ms"
+	ActiveWorkersName         = "mysql_active_workers"
+	LaneDropCountName         = "mysql_lane_drop_count"
+	RateLimitedCountName      = "mysql_rate_limited_count"
+	SamplingKeptCountName     = "mysql_sampling_kept_count"
+	SamplingDroppedCountName  = "mysql_sampling_dropped_count"
+	TailKeptTraceCountName    = "mysql_tail_kept_trace_count"
+	TailDroppedTraceCountName = "mysql_tail_dropped_trace_count"
+	TailEvictedTraceCountName = "mysql_tail_evicted_trace_count"
+	TailBufferedSpansName     = "mysql_tail_buffered_spans"
+	TailForwardDropCountName  = "mysql_tail_forward_drop_count"
+	CacheFlushErrorName       = "mysql_cache_flush_error_count"
+	OperationOverflowCountName = "mysql_operation_overflow_count"
 )
 
 // Factory implements storage.Factory and creates storage components backed by mysql store.
@@ -45,7 +69,12 @@ type Factory struct {
 	logger          *zap.Logger
 	store           *sql.DB
 	cacheStore      *mSpanStore.CacheStore
+	aliases         *mSpanStore.ServiceAliases
+	tagIndex        *mSpanStore.TagIndex
+	promoted        *mSpanStore.PromotedTags
 	backgroudStore  *mSpanStore.BackgroudStore
+	spill           *mSpanStore.SpillQueue
+	spanWriter      *mSpanStore.SpanWriter
 	eventQueue      chan *dbmodel.Span
 	maintenanceDone chan bool
 
@@ -53,6 +82,35 @@ type Factory struct {
 		// SpanDropCount returns the count of dropped span when the queue is full
 		SpanDropCount         metrics.Counter
 		MysqlBatchInsertError metrics.Counter
+		// SpanSpillCount returns the count of spans written to the spill queue
+		SpanSpillCount        metrics.Counter
+		SpanReplayCount       metrics.Counter
+		SpanSpillDiscardCount metrics.Counter
+		MysqlBatchInsertRetry metrics.Counter
+		// DeadLetterSpanCount returns the count of spans handed to the dead letter sink
+		DeadLetterSpanCount   metrics.Counter
+		DeadLetterError       metrics.Counter
+		// SpanRejectedCount returns the count of single spans mysql refused to store, by reason
+		SpanRejectedCount     map[string]metrics.Counter
+		// WorkerQueueDepth returns the number of spans waiting in each worker queue with trace affinity
+		WorkerQueueDepth      []metrics.Gauge
+		AffinityRerouteCount  metrics.Counter
+		// BatchSize, LingerTime and ActiveWorkers return the values picked by the adaptive batching
+		BatchSize             metrics.Gauge
+		LingerTime            metrics.Gauge
+		ActiveWorkers         metrics.Gauge
+		// LaneDropCount is indexed by the lane of the priority queue
+		LaneDropCount         []metrics.Counter
+		SamplingKeptCount     metrics.Counter
+		SamplingDroppedCount  metrics.Counter
+		TailKeptTraceCount    metrics.Counter
+		TailDroppedTraceCount metrics.Counter
+		// TailEvictedTraceCount counts the traces decided early because the tail sampling buffer is full
+		TailEvictedTraceCount metrics.Counter
+		TailBufferedSpans     metrics.Gauge
+		// TailForwardDropCount counts the spans of retained traces dropped because the queue is full
+		TailForwardDropCount  metrics.Counter
+		CacheFlushError       metrics.Counter
 	}
 }
 
@@ -79,6 +137,125 @@ func (f *Factory) Initialize(metricsFactory metrics.Factory, logger *zap.Logger)
 
 	f.metrics.SpanDropCount = metricsFactory.Counter(metrics.Options{Name: SpanDropCountName})
 	f.metrics.MysqlBatchInsertError = metricsFactory.Counter(metrics.Options{Name: MysqlBatchInsertErrorName})
+	f.metrics.SpanSpillCount = metricsFactory.Counter(metrics.Options{Name: SpanSpillCountName})
+	f.metrics.SpanReplayCount = metricsFactory.Counter(metrics.Options{Name: SpanReplayCountName})
+	f.metrics.SpanSpillDiscardCount = metricsFactory.Counter(metrics.Options{Name: SpanSpillDiscardCountName})
+	f.metrics.MysqlBatchInsertRetry = metricsFactory.Counter(metrics.Options{Name: MysqlBatchInsertRetryName})
+	f.metrics.DeadLetterSpanCount = metricsFactory.Counter(metrics.Options{Name: DeadLetterSpanCountName})
+	f.metrics.DeadLetterError = metricsFactory.Counter(metrics.Options{Name: DeadLetterErrorName})
+	f.metrics.SpanRejectedCount = map[string]metrics.Counter{}
+	for _, reason := range mSpanStore.SpanRejectReasons() {
+		f.metrics.SpanRejectedCount[reason] = metricsFactory.Counter(metrics.Options{Name: SpanRejectedCountName,
+			Tags: map[string]string{"reason": reason}})
+	}
+	workers := f.options.Configuration.Workers
+	if f.options.Configuration.Adaptive {
+		workers = f.options.Configuration.MaxWorkers
+	}
+	for i := 0; i < workers; i++ {
+		f.metrics.WorkerQueueDepth = append(f.metrics.WorkerQueueDepth, metricsFactory.Gauge(metrics.Options{Name: WorkerQueueDepthName,
+			Tags: map[string]string{"worker": strconv.Itoa(i)}}))
+	}
+	f.metrics.AffinityRerouteCount = metricsFactory.Counter(metrics.Options{Name: AffinityRerouteCountName})
+	f.metrics.BatchSize = metricsFactory.Gauge(metrics.Options{Name: BatchSizeName})
+	f.metrics.LingerTime = metricsFactory.Gauge(metrics.Options{Name: LingerTimeName})
+	f.metrics.ActiveWorkers = metricsFactory.Gauge(metrics.Options{Name: ActiveWorkersName})
+	for _, lane := range mSpanStore.LaneNames {
+		f.metrics.LaneDropCount = append(f.metrics.LaneDropCount, metricsFactory.Counter(metrics.Options{Name: LaneDropCountName,
+			Tags: map[string]string{"lane": lane}}))
+	}
+
+	f.metrics.SamplingKeptCount = metricsFactory.Counter(metrics.Options{Name: SamplingKeptCountName})
+	f.metrics.SamplingDroppedCount = metricsFactory.Counter(metrics.Options{Name: SamplingDroppedCountName})
+	f.metrics.TailKeptTraceCount = metricsFactory.Counter(metrics.Options{Name: TailKeptTraceCountName})
+	f.metrics.TailDroppedTraceCount = metricsFactory.Counter(metrics.Options{Name: TailDroppedTraceCountName})
+	f.metrics.TailEvictedTraceCount = metricsFactory.Counter(metrics.Options{Name: TailEvictedTraceCountName})
+	f.metrics.TailBufferedSpans = metricsFactory.Gauge(metrics.Options{Name: TailBufferedSpansName})
+	f.metrics.TailForwardDropCount = metricsFactory.Counter(metrics.Options{Name: TailForwardDropCountName})
+	f.metrics.CacheFlushError = metricsFactory.Counter(metrics.Options{Name: CacheFlushErrorName})
+
+	if f.options.err != nil {
+		return f.options.err
+	}
+	if err := mSpanStore.ValidateWriteMode(f.options.Configuration.WriteMode); err != nil {
+		return err
+	}
+	if err := mSpanStore.ValidateInsertMethod(f.options.Configuration.InsertMethod); err != nil {
+		return err
+	}
+	if err := mSpanStore.ValidateOverflowPolicy(f.options.Configuration.OverflowPolicy); err != nil {
+		return err
+	}
+	if err := mSpanStore.ValidateSchema(f.options.Configuration.Schema); err != nil {
+		return err
+	}
+
+	if f.options.Configuration.TailSampling && f.options.Configuration.WriteMode == mSpanStore.WriteModeSync {
+		return fmt.Errorf("tail sampling can not be used with the %s write mode", mSpanStore.WriteModeSync)
+	}
+	var tail *mSpanStore.TailSampler
+	if f.options.Configuration.TailSampling {
+		tailOptions := mSpanStore.TailSamplingOptions{
+			DecisionWait: time.Duration(f.options.Configuration.TailDecisionWait) * time.Millisecond,
+			MaxSpans:     f.options.Configuration.TailMaxSpans,
+			RootDuration: time.Duration(f.options.Configuration.TailRootDuration) * time.Millisecond,
+			Tags:         f.options.Configuration.TailTags,
+		}
+		tailMetrics := mSpanStore.NewTailMetrics(f.metrics.TailKeptTraceCount, f.metrics.TailDroppedTraceCount,
+			f.metrics.TailEvictedTraceCount, f.metrics.TailBufferedSpans, f.metrics.TailForwardDropCount)
+		tail = mSpanStore.NewTailSampler(tailOptions, f.logger, tailMetrics)
+	}
+
+	var sampler *mSpanStore.Sampler
+	if f.options.Configuration.SamplingRules != "" {
+		rules, err := mSpanStore.LoadSamplingRules(f.options.Configuration.SamplingRules)
+		if err != nil {
+			logger.Error("Cannot load sampling rules", zap.Error(err))
+			return err
+		}
+		sampler = mSpanStore.NewSampler(rules, f.metrics.SamplingKeptCount, f.metrics.SamplingDroppedCount)
+	}
+
+	if len(f.options.Configuration.ServiceAliases) > 0 {
+		aliases := map[string]string{}
+		for _, alias := range f.options.Configuration.ServiceAliases {
+			aliases[alias.Name] = alias.Canonical
+		}
+		var err error
+		f.aliases, err = mSpanStore.NewServiceAliases(aliases)
+		if err != nil {
+			logger.Error("Cannot resolve service aliases", zap.Error(err))
+			return err
+		}
+	}
+
+	if len(f.options.Configuration.PromotedTags) > 0 {
+		var err error
+		f.promoted, err = mSpanStore.NewPromotedTags(f.options.Configuration.PromotedTags)
+		if err != nil {
+			logger.Error("Cannot name the promoted tag columns", zap.Error(err))
+			return err
+		}
+	}
+	if f.options.Configuration.TagIndex {
+		// the promoted tags are searched on their own column
+		deny := append(append([]string{}, f.options.Configuration.TagIndexDeny...), f.options.Configuration.PromotedTags...)
+		f.tagIndex = mSpanStore.NewTagIndex(f.options.Configuration.TagIndexAllow, deny)
+	}
+
+	var normalizer *mSpanStore.Normalizer
+	if len(f.options.Configuration.OperationRules) > 0 {
+		var rules []mSpanStore.OperationRule
+		for _, rule := range f.options.Configuration.OperationRules {
+			rules = append(rules, mSpanStore.OperationRule{Service: rule.Service, Pattern: rule.Pattern, Replacement: rule.Replacement})
+		}
+		var err error
+		normalizer, err = mSpanStore.NewNormalizer(rules)
+		if err != nil {
+			logger.Error("Cannot compile operation rules", zap.Error(err))
+			return err
+		}
+	}
 
 	db, err := sql.Open("mysql", f.options.Configuration.Url) // 建立一个mysql连接对象
 	if err != nil {
@@ -87,13 +264,91 @@ func (f *Factory) Initialize(metricsFactory metrics.Factory, logger *zap.Logger)
 	}
 	f.store = db
 
-	f.cacheStore = mSpanStore.NewCacheStore(f.store, f.logger)
+	if f.promoted != nil {
+		missing, err := f.promoted.MissingColumns(f.store)
+		if err != nil {
+			logger.Error("Cannot read the traces columns", zap.Error(err))
+			return err
+		}
+		if len(missing) > 0 {
+			logger.Error("The traces table misses the columns of promoted tags, run the migration or the promote-tags admin command",
+				zap.Strings("tags", missing), zap.String("migration", f.promoted.MigrationSQL(missing)))
+			return fmt.Errorf("traces table misses the columns of the promoted tags %v", missing)
+		}
+	}
+
+	retry := mSpanStore.NewRetryPolicy(f.options.Configuration.RetryAttempts, f.options.Configuration.RetryBackoff,
+		f.options.Configuration.RetryMaxBackoff)
+	cacheOptions := mSpanStore.CacheOptions{
+		Retention:               time.Duration(f.options.Configuration.Expired) * 24 * time.Hour,
+		MaxOperationsPerService: f.options.Configuration.MaxOperationsPerService,
+		OverflowOperationName:   f.options.Configuration.OverflowOperationName,
+	}
+	f.cacheStore = mSpanStore.NewCacheStore(f.store, retry, cacheOptions, f.logger, f.metrics.CacheFlushError,
+		func(service string) metrics.Counter {
+			return f.metricsFactory.Counter(metrics.Options{Name: OperationOverflowCountName, Tags: map[string]string{"service": service}})
+		})
 	f.cacheStore.Initialize()
 
-	f.eventQueue = make(chan *dbmodel.Span, f.options.Configuration.QueueLength)
-	f.backgroudStore = mSpanStore.NewBackgroudStore(f.store, f.eventQueue, f.logger, f.options.Configuration.LingerTime,
-		f.options.Configuration.Batchsize, f.options.Configuration.Workers, f.metrics.MysqlBatchInsertError)
+	if f.options.Configuration.SpillDir != "" {
+		spillMetrics := mSpanStore.NewSpillMetrics(f.metrics.SpanSpillCount, f.metrics.SpanReplayCount, f.metrics.SpanSpillDiscardCount)
+		f.spill, err = mSpanStore.NewSpillQueue(f.options.Configuration.SpillDir,
+			int64(f.options.Configuration.SpillMaxSize) << 20,
+			int64(f.options.Configuration.SpillSegmentSize) << 20,
+			f.logger, spillMetrics)
+		if err != nil {
+			logger.Error("Cannot open spill queue", zap.Error(err))
+			return err
+		}
+	}
+
+	deadLetter, err := mSpanStore.NewDeadLetterSink(f.options.Configuration.DeadLetter, f.store, f.options.Configuration.DeadLetterFile)
+	if err != nil {
+		logger.Error("Cannot create dead letter sink", zap.Error(err))
+		return err
+	}
+	backgroudMetrics := mSpanStore.NewBackgroudMetrics(f.metrics.MysqlBatchInsertError, f.metrics.MysqlBatchInsertRetry,
+		f.metrics.DeadLetterSpanCount, f.metrics.DeadLetterError, f.metrics.SpanRejectedCount,
+		f.metrics.WorkerQueueDepth, f.metrics.AffinityRerouteCount,
+		f.metrics.BatchSize, f.metrics.LingerTime, f.metrics.ActiveWorkers)
+	backgroudOptions := mSpanStore.BackgroudOptions{
+		LingerTime:    f.options.Configuration.LingerTime,
+		Batchsize:     f.options.Configuration.Batchsize,
+		Workers:       f.options.Configuration.Workers,
+		Idempotent:    f.options.Configuration.IdempotentWrites,
+		TraceAffinity: f.options.Configuration.TraceAffinity,
+		Adaptive:      f.options.Configuration.Adaptive,
+		MinBatchsize:  f.options.Configuration.MinBatchsize,
+		MaxBatchsize:  f.options.Configuration.MaxBatchsize,
+		MinWorkers:    f.options.Configuration.MinWorkers,
+		MaxWorkers:    f.options.Configuration.MaxWorkers,
+		TargetLatency: f.options.Configuration.TargetLatency,
+		InsertMethod:  f.options.Configuration.InsertMethod,
+		Promoted:      f.promoted,
+		FullText:      f.options.Configuration.FullText,
+	}
+
+	var priority *mSpanStore.PriorityQueue
+	if f.options.Configuration.PriorityQueue {
+		// the lanes hold the backlog, the eventQueue only keeps the workers busy
+		f.eventQueue = make(chan *dbmodel.Span, f.options.Configuration.Batchsize * f.options.Configuration.Workers)
+		priority = mSpanStore.NewPriorityQueue(f.eventQueue, f.options.Configuration.PriorityLaneLength,
+			f.options.Configuration.NormalLaneLength, f.options.Configuration.OverflowPolicy)
+	} else {
+		f.eventQueue = make(chan *dbmodel.Span, f.options.Configuration.QueueLength)
+	}
+	f.backgroudStore = mSpanStore.NewBackgroudStore(f.store, f.eventQueue, f.spill, priority, retry, deadLetter, f.logger,
+		backgroudOptions, backgroudMetrics)
 	f.backgroudStore.Start()
+	// all the writers share the eventQueue, so a single writer is handed out to be able to close it once
+	writeOptions := mSpanStore.WriteOptions{
+		Mode:         f.options.Configuration.WriteMode,
+		Timeout:      time.Duration(f.options.Configuration.WriteTimeout) * time.Millisecond,
+		SyncBatching: f.options.Configuration.WriteSyncBatching,
+		FullText:     f.options.Configuration.FullText,
+	}
+	f.spanWriter = mSpanStore.NewSpanWriter(f.eventQueue, f.cacheStore, f.spill, priority, f.aliases, normalizer,
+		f.tagIndex, f.promoted, f.rateLimiter(), sampler, tail, f.backgroudStore, writeOptions, f.logger, f.metrics.SpanDropCount, f.metrics.LaneDropCount)
 
 	go f.maintenance()
 
@@ -101,6 +356,31 @@ func (f *Factory) Initialize(metricsFactory metrics.Factory, logger *zap.Logger)
 	return nil
 }
 
+// rateLimiter returns the limiter of the spans per service, nil when no service is limited
+func (f *Factory) rateLimiter() *mSpanStore.RateLimiter {
+	if f.options.Configuration.RateLimit <= 0 && len(f.options.Configuration.RateLimits) == 0 {
+		return nil
+	}
+	defaultLimit := mSpanStore.RateLimit{Rate: f.options.Configuration.RateLimit, Burst: f.options.Configuration.RateLimitBurst}
+	services := map[string]mSpanStore.RateLimit{}
+	operations := map[string]map[string]mSpanStore.RateLimit{}
+	for service, limit := range f.options.Configuration.RateLimits {
+		// a service with only operation limits keeps the default limit
+		if limit.Rate > 0 {
+			services[service] = mSpanStore.RateLimit{Rate: limit.Rate, Burst: limit.Burst}
+		}
+		for operation, operationLimit := range limit.Operations {
+			if operations[service] == nil {
+				operations[service] = map[string]mSpanStore.RateLimit{}
+			}
+			operations[service][operation] = mSpanStore.RateLimit{Rate: operationLimit.Rate, Burst: operationLimit.Burst}
+		}
+	}
+	return mSpanStore.NewRateLimiter(defaultLimit, services, operations, func(service string) metrics.Counter {
+		return f.metricsFactory.Counter(metrics.Options{Name: RateLimitedCountName, Tags: map[string]string{"service": service}})
+	})
+}
+
 // Maintenance starts a background maintenance job for the clean mysql expired data
 func (f *Factory) maintenance() {
 	expired := int64(f.options.Configuration.Expired * 3600 * 24)
@@ -115,24 +395,36 @@ func (f *Factory) maintenance() {
             // delete expired mysql data
 			startTime := (time.Now().Unix() - expired) * 1000000
 			startTime1 := startTime - 30 * 60 * 1000000   // interval time 
-			sql := fmt.Sprintf("delete from traces where start_time <= %d and start_time > %d limit 1000", startTime, startTime1)
-			var rowsaffectedTotal int
-			for {
-				rowsaffected, err := deleteMysqlExpiredData(f.store, sql)
-				rowsaffectedTotal = rowsaffectedTotal + rowsaffected
-				if err == nil && rowsaffected < 1000 {
-					break
-				}
-				if err != nil {
-					f.logger.Error("delete expired mysql data error", zap.Error(err))	
+			tables := []string{"traces"}
+			if f.tagIndex != nil {
+				tables = append(tables, "span_tags")
+			}
+			for _, table := range tables {
+				sql := fmt.Sprintf("delete from %s where start_time <= %d and start_time > %d limit 1000", table, startTime, startTime1)
+				var rowsaffectedTotal int
+				for {
+					rowsaffected, err := deleteMysqlExpiredData(f.store, sql)
+					rowsaffectedTotal = rowsaffectedTotal + rowsaffected
+					if err == nil && rowsaffected < 1000 {
+						break
+					}
+					if err != nil {
+						f.logger.Error("delete expired mysql data error", zap.Error(err), zap.String("table", table))
+					}
+					time.Sleep(1 * time.Second)
+					f.logger.Info("delete expired mysql data", zap.String("table", table), zap.Int("rowsAffected", rowsaffected))
 				}
-				time.Sleep(1 * time.Second)
-				f.logger.Info("delete expired mysql data", zap.Int("rowsAffected", rowsaffected))
+
+				f.logger.Info("delete expired mysql data success", zap.String("table", table),
+																	zap.Int("expired(d)", f.options.Configuration.Expired), 
+																	zap.Int("interval(m)", f.options.Configuration.Interval),
+																	zap.Int("rowsaffectedTotal", rowsaffectedTotal))
 			}
 
-			f.logger.Info("delete expired mysql data success", zap.Int("expired(d)", f.options.Configuration.Expired), 
-																zap.Int("interval(m)", f.options.Configuration.Interval),
-																zap.Int("rowsaffectedTotal", rowsaffectedTotal))
+			// services and operations not seen since the expired traces are gone as well
+			if err := f.cacheStore.Prune(); err != nil {
+				f.logger.Error("prune services and operations error", zap.Error(err))
+			}
 
 			// todo metrics
 		}
@@ -149,24 +441,45 @@ func deleteMysqlExpiredData(db *sql.DB, sql string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return rowsaffected, nil
+	return int(rowsaffected), nil
 }
 
-// Close Implements io.Closer and closes the underlying storage
+// Close Implements io.Closer and closes the underlying storage.
+// New spans are refused first, then the pending spans are flushed before the mysql client is closed.
+// Only the parts created by Initialize are closed, it may have failed half way.
 func (f *Factory) Close() error {
 	close(f.maintenanceDone)
+	if f.spanWriter != nil {
+		f.spanWriter.Close()
+	}
+	if f.backgroudStore != nil {
+		timeout := time.Duration(f.options.Configuration.ShutdownTimeout) * time.Second
+		flushed, lost := f.backgroudStore.Shutdown(timeout)
+		f.metrics.SpanDropCount.Inc(lost)
+		f.logger.Info("mysql storage flushed pending spans", zap.Int64("flushed", flushed), zap.Int64("lost", lost))
+	}
+	if f.cacheStore != nil {
+		f.cacheStore.Close()
+	}
+	if f.spill != nil {
+		f.spill.Close()
+	}
+	if f.store == nil {
+		return nil
+	}
 	err := f.store.Close()
 	return err
 }
 
 // CreateSpanReader implements storage.Factory
 func (f *Factory) CreateSpanReader() (spanstore.Reader, error) {
-	return mSpanStore.NewSpanReader(f.store, f.cacheStore, f.logger), nil
+	return mSpanStore.NewSpanReader(f.store, f.cacheStore, f.aliases, f.tagIndex, f.promoted,
+		f.options.Configuration.Schema, f.options.Configuration.FullText, f.logger), nil
 }
 
 // CreateSpanWriter implements storage.Factory
 func (f *Factory) CreateSpanWriter() (spanstore.Writer, error) {
-	return mSpanStore.NewSpanWriter(f.eventQueue, f.cacheStore, f.logger, f.metrics.SpanDropCount), nil
+	return f.spanWriter, nil
 }
 
 // CreateDependencyReader implements storage.Factory
@@ -17,6 +17,7 @@ package mysql
 import (
 	"flag"
 	"fmt"
+	"strings"
 
 	"github.com/spf13/viper"
 
@@ -36,11 +37,73 @@ const (
 	workers     = "mysql.workers"
 	expired     = "mysql.expired"     
 	interval    = "mysql.interval" 
+	spillDir         = "mysql.spillDir"
+	spillMaxSize     = "mysql.spillMaxSize"
+	spillSegmentSize = "mysql.spillSegmentSize"
+	retryAttempts    = "mysql.retryAttempts"
+	retryBackoff     = "mysql.retryBackoff"
+	retryMaxBackoff  = "mysql.retryMaxBackoff"
+	deadLetter       = "mysql.deadLetter"
+	deadLetterFile   = "mysql.deadLetterFile"
+	shutdownTimeout  = "mysql.shutdownTimeout"
+	writeMode         = "mysql.write-mode"
+	writeTimeout      = "mysql.write-timeout"
+	writeSyncBatching = "mysql.write-sync-batching"
+	idempotentWrites  = "mysql.idempotentWrites"
+	traceAffinity     = "mysql.traceAffinity"
+	adaptive          = "mysql.adaptive"
+	minBatchsize      = "mysql.minBatchsize"
+	maxBatchsize      = "mysql.maxBatchsize"
+	minWorkers        = "mysql.minWorkers"
+	maxWorkers        = "mysql.maxWorkers"
+	targetLatency     = "mysql.targetLatency"
+	insertMethod      = "mysql.insertMethod"
+	priorityQueue      = "mysql.priorityQueue"
+	priorityLaneLength = "mysql.priorityLaneLength"
+	normalLaneLength   = "mysql.normalLaneLength"
+	overflowPolicy     = "mysql.overflowPolicy"
+	rateLimit          = "mysql.rateLimit"
+	rateLimitBurst     = "mysql.rateLimitBurst"
+	// rateLimits only comes from the config file, e.g.
+	// rateLimits:
+	//   chatty-service:
+	//     rate: 100
+	//     burst: 200
+	//     operations:
+	//       "GET /health": {rate: 1}
+	rateLimits         = "mysql.rateLimits"
+	// operationRules only comes from the config file, e.g.
+	// operationRules:
+	//   - service: users
+	//     pattern: "/[0-9]+"
+	//     replacement: "/{id}"
+	operationRules     = "mysql.operationRules"
+	// serviceAliases only comes from the config file, e.g.
+	// serviceAliases:
+	//   - name: old-users
+	//     canonical: users
+	serviceAliases     = "mysql.serviceAliases"
+	tagIndex           = "mysql.tagIndex"
+	tagIndexAllow      = "mysql.tagIndexAllow"
+	tagIndexDeny       = "mysql.tagIndexDeny"
+	promotedTags       = "mysql.promotedTags"
+	schema             = "mysql.schema"
+	fullText           = "mysql.fullText"
+	samplingRules      = "mysql.samplingRules"
+	tailSampling       = "mysql.tailSampling"
+	tailDecisionWait   = "mysql.tailDecisionWait"
+	tailMaxSpans       = "mysql.tailMaxSpans"
+	tailRootDuration   = "mysql.tailRootDuration"
+	tailTags           = "mysql.tailTags"
+	maxOperationsPerService = "mysql.maxOperationsPerService"
+	overflowOperationName   = "mysql.overflowOperationName"
 )
 
 // Options stores the configuration entries for this storage
 type Options struct {
 	Configuration config.Configuration
+	// err is what InitFromViper could not parse, it is reported by Initialize
+	err           error
 }
 
 // AddFlags from this storage to the CLI
@@ -57,6 +120,48 @@ func (opt *Options) AddFlags(flagSet *flag.FlagSet) {
 	flagSet.Int(workers, opt.Configuration.Workers, "The mysql cluster write workers")
 	flagSet.Int(expired, opt.Configuration.Expired, "The mysql data expired time (days)")
 	flagSet.Int(interval, opt.Configuration.Interval, "The interval time to clean expired mysql data (Minute)")
+	flagSet.String(spillDir, opt.Configuration.SpillDir, "The directory to spill spans to when the queue is full, disabled when empty")
+	flagSet.Int(spillMaxSize, opt.Configuration.SpillMaxSize, "The max total size of the spill directory (MB)")
+	flagSet.Int(spillSegmentSize, opt.Configuration.SpillSegmentSize, "The size of one spill segment file (MB)")
+	flagSet.Int(retryAttempts, opt.Configuration.RetryAttempts, "The max attempts of one batch insert, including the first one")
+	flagSet.Int(retryBackoff, opt.Configuration.RetryBackoff, "The initial backoff between batch insert retries (Millisecond)")
+	flagSet.Int(retryMaxBackoff, opt.Configuration.RetryMaxBackoff, "The max backoff between batch insert retries (Millisecond)")
+	flagSet.String(deadLetter, opt.Configuration.DeadLetter, "Where to keep the batches that failed after all retries: table, file or empty to drop them")
+	flagSet.String(deadLetterFile, opt.Configuration.DeadLetterFile, "The dead letter file path when mysql.deadLetter is file, or the fallback of the table when it can not be written (default traces_dead_letter.json)")
+	flagSet.Int(shutdownTimeout, opt.Configuration.ShutdownTimeout, "The max time to flush the pending spans on shutdown (Second)")
+	flagSet.String(writeMode, opt.Configuration.WriteMode, "How spans are written: async-drop (drop when the queue is full), async-block (wait for the queue, then fail) or sync (insert before returning)")
+	flagSet.Int(writeTimeout, opt.Configuration.WriteTimeout, "The max time async-block waits for room in the queue (Millisecond)")
+	flagSet.Bool(writeSyncBatching, opt.Configuration.WriteSyncBatching, "Group the spans of concurrent writers into one insert in sync mode")
+	// harmless without the unique key, so it is on unless told otherwise
+	flagSet.Bool(idempotentWrites, true, "Skip the spans already stored, requires the (trace_id, span_hash) unique key on traces")
+	flagSet.Bool(traceAffinity, opt.Configuration.TraceAffinity, "Route all the spans of a trace to the same write worker")
+	flagSet.Bool(adaptive, opt.Configuration.Adaptive, "Tune the batch size, the linger time and the number of active workers from the observed mysql latency")
+	flagSet.Int(minBatchsize, opt.Configuration.MinBatchsize, "The min write batch size when adaptive")
+	flagSet.Int(maxBatchsize, opt.Configuration.MaxBatchsize, "The max write batch size when adaptive")
+	flagSet.Int(minWorkers, opt.Configuration.MinWorkers, "The min active write workers when adaptive")
+	flagSet.Int(maxWorkers, opt.Configuration.MaxWorkers, "The max active write workers when adaptive")
+	flagSet.Int(targetLatency, opt.Configuration.TargetLatency, "The batch insert latency above which batches stop growing when adaptive (Millisecond)")
+	flagSet.String(insertMethod, opt.Configuration.InsertMethod, "How batches are stored: insert or load-data (LOAD DATA LOCAL INFILE, needs local_infile=ON)")
+	flagSet.Bool(priorityQueue, opt.Configuration.PriorityQueue, "Queue the error, 5xx and debug spans in a priority lane that is written first and dropped last")
+	flagSet.Int(priorityLaneLength, opt.Configuration.PriorityLaneLength, "The capacity of the priority lane, default queueLength/10 and at least 1")
+	flagSet.Int(normalLaneLength, opt.Configuration.NormalLaneLength, "The capacity of the normal lane, default queueLength")
+	flagSet.String(overflowPolicy, opt.Configuration.OverflowPolicy, "The span dropped when a lane is full: drop-newest, drop-oldest or drop-lowest-priority")
+	flagSet.Float64(rateLimit, opt.Configuration.RateLimit, "The default max spans per second of a service, 0 for no limit")
+	flagSet.Int(rateLimitBurst, opt.Configuration.RateLimitBurst, "The default max burst of spans of a service, default one second of rateLimit")
+	flagSet.String(samplingRules, opt.Configuration.SamplingRules, "The path of the yaml file with the write-time sampling rules, empty to store every span")
+	flagSet.Bool(tailSampling, opt.Configuration.TailSampling, "Buffer the spans by trace and only store the traces retained by the tail sampling policies, not available in sync write mode")
+	flagSet.Int(tailDecisionWait, opt.Configuration.TailDecisionWait, "How long the spans of a trace are buffered before the tail sampling decision (Millisecond)")
+	flagSet.Int(tailMaxSpans, opt.Configuration.TailMaxSpans, "The max spans buffered for tail sampling, the oldest traces are decided early beyond it")
+	flagSet.Int(tailRootDuration, opt.Configuration.TailRootDuration, "Retain the traces whose root span lasts at least that long, 0 to disable (Millisecond)")
+	flagSet.String(tailTags, "", "Retain the traces with a span or its process holding one of these comma separated tags, key or key=value")
+	flagSet.Int(maxOperationsPerService, opt.Configuration.MaxOperationsPerService, "The max operations of a service, the new ones beyond it are stored as mysql.overflowOperationName, 0 for no cap")
+	flagSet.Bool(tagIndex, opt.Configuration.TagIndex, "Write the span and process tags to the span_tags table so that any tag can be searched")
+	flagSet.String(tagIndexAllow, "", "The comma separated tag keys written to span_tags, empty for all of them")
+	flagSet.String(tagIndexDeny, "", "The comma separated tag keys never written to span_tags")
+	flagSet.String(promotedTags, "", "The comma separated tag keys written to a traces column of their own, tag_<key>, e.g. http.method,peer.service")
+	flagSet.String(schema, opt.Configuration.Schema, "The traces schema: text (sql/full.sql, mysql 5.7) or json (sql/full_mysql8.sql, mysql >= 8.0.17, tags searchable in the JSON columns)")
+	flagSet.Bool(fullText, opt.Configuration.FullText, "Write the tag and log values to the FULLTEXT indexed search_text column (sql/migrations/006_search_text.sql) so that the _text tag searches them")
+	flagSet.String(overflowOperationName, opt.Configuration.OverflowOperationName, "The operation name of the spans whose service has too many operations")
 }
 
 // InitFromViper initializes the options struct with values from Viper
@@ -81,6 +186,59 @@ func (opt *Options) InitFromViper(v *viper.Viper) {
 	opt.Configuration.Workers = v.GetInt(workers)
 	opt.Configuration.Expired = v.GetInt(expired)
 	opt.Configuration.Interval = v.GetInt(interval)
+	opt.Configuration.SpillDir = v.GetString(spillDir)
+	opt.Configuration.SpillMaxSize = v.GetInt(spillMaxSize)
+	opt.Configuration.SpillSegmentSize = v.GetInt(spillSegmentSize)
+	opt.Configuration.RetryAttempts = v.GetInt(retryAttempts)
+	opt.Configuration.RetryBackoff = v.GetInt(retryBackoff)
+	opt.Configuration.RetryMaxBackoff = v.GetInt(retryMaxBackoff)
+	opt.Configuration.DeadLetter = v.GetString(deadLetter)
+	opt.Configuration.DeadLetterFile = v.GetString(deadLetterFile)
+	opt.Configuration.ShutdownTimeout = v.GetInt(shutdownTimeout)
+	opt.Configuration.WriteMode = v.GetString(writeMode)
+	opt.Configuration.WriteTimeout = v.GetInt(writeTimeout)
+	opt.Configuration.WriteSyncBatching = v.GetBool(writeSyncBatching)
+	opt.Configuration.IdempotentWrites = v.GetBool(idempotentWrites)
+	opt.Configuration.TraceAffinity = v.GetBool(traceAffinity)
+	opt.Configuration.Adaptive = v.GetBool(adaptive)
+	opt.Configuration.MinBatchsize = v.GetInt(minBatchsize)
+	opt.Configuration.MaxBatchsize = v.GetInt(maxBatchsize)
+	opt.Configuration.MinWorkers = v.GetInt(minWorkers)
+	opt.Configuration.MaxWorkers = v.GetInt(maxWorkers)
+	opt.Configuration.TargetLatency = v.GetInt(targetLatency)
+	opt.Configuration.InsertMethod = v.GetString(insertMethod)
+	opt.Configuration.PriorityQueue = v.GetBool(priorityQueue)
+	opt.Configuration.PriorityLaneLength = v.GetInt(priorityLaneLength)
+	opt.Configuration.NormalLaneLength = v.GetInt(normalLaneLength)
+	opt.Configuration.OverflowPolicy = v.GetString(overflowPolicy)
+	opt.Configuration.RateLimit = v.GetFloat64(rateLimit)
+	opt.Configuration.RateLimitBurst = v.GetInt(rateLimitBurst)
+	opt.Configuration.SamplingRules = v.GetString(samplingRules)
+	opt.Configuration.TailSampling = v.GetBool(tailSampling)
+	opt.Configuration.TailDecisionWait = v.GetInt(tailDecisionWait)
+	opt.Configuration.TailMaxSpans = v.GetInt(tailMaxSpans)
+	opt.Configuration.TailRootDuration = v.GetInt(tailRootDuration)
+	opt.Configuration.TailTags = splitList(v.GetString(tailTags))
+	opt.Configuration.MaxOperationsPerService = v.GetInt(maxOperationsPerService)
+	opt.Configuration.OverflowOperationName = v.GetString(overflowOperationName)
+	opt.Configuration.TagIndex = v.GetBool(tagIndex)
+	opt.Configuration.TagIndexAllow = splitList(v.GetString(tagIndexAllow))
+	opt.Configuration.TagIndexDeny = splitList(v.GetString(tagIndexDeny))
+	opt.Configuration.PromotedTags = splitList(v.GetString(promotedTags))
+	opt.Configuration.Schema = v.GetString(schema)
+	opt.Configuration.FullText = v.GetBool(fullText)
+	opt.Configuration.RateLimits = nil
+	if err := v.UnmarshalKey(rateLimits, &opt.Configuration.RateLimits); err != nil {
+		opt.err = fmt.Errorf("invalid %s: %v", rateLimits, err)
+	}
+	opt.Configuration.OperationRules = nil
+	if err := v.UnmarshalKey(operationRules, &opt.Configuration.OperationRules); err != nil {
+		opt.err = fmt.Errorf("invalid %s: %v", operationRules, err)
+	}
+	opt.Configuration.ServiceAliases = nil
+	if err := v.UnmarshalKey(serviceAliases, &opt.Configuration.ServiceAliases); err != nil {
+		opt.err = fmt.Errorf("invalid %s: %v", serviceAliases, err)
+	}
 	// set default value 
 	if opt.Configuration.QueueLength == 0{
 		opt.Configuration.QueueLength = 1000000
@@ -100,4 +258,85 @@ func (opt *Options) InitFromViper(v *viper.Viper) {
 	if opt.Configuration.Interval == 0{
 		opt.Configuration.Interval = 10   // default 10 Minute
 	}
+	if opt.Configuration.SpillMaxSize == 0{
+		opt.Configuration.SpillMaxSize = 1024   // default 1G
+	}
+	if opt.Configuration.SpillSegmentSize == 0{
+		opt.Configuration.SpillSegmentSize = 64   // default 64M
+	}
+	if opt.Configuration.RetryAttempts == 0{
+		opt.Configuration.RetryAttempts = 3
+	}
+	if opt.Configuration.RetryBackoff == 0{
+		opt.Configuration.RetryBackoff = 100
+	}
+	if opt.Configuration.RetryMaxBackoff == 0{
+		opt.Configuration.RetryMaxBackoff = 5000
+	}
+	if opt.Configuration.ShutdownTimeout == 0{
+		opt.Configuration.ShutdownTimeout = 10   // default 10 Second
+	}
+	if opt.Configuration.WriteMode == ""{
+		opt.Configuration.WriteMode = "async-drop"
+	}
+	if opt.Configuration.WriteTimeout == 0{
+		opt.Configuration.WriteTimeout = 1000
+	}
+	if opt.Configuration.MinBatchsize == 0{
+		opt.Configuration.MinBatchsize = 10
+	}
+	if opt.Configuration.MaxBatchsize == 0{
+		opt.Configuration.MaxBatchsize = 500
+	}
+	if opt.Configuration.MinWorkers == 0{
+		opt.Configuration.MinWorkers = 1
+	}
+	if opt.Configuration.MaxWorkers == 0{
+		opt.Configuration.MaxWorkers = opt.Configuration.Workers * 2
+	}
+	if opt.Configuration.MaxWorkers < opt.Configuration.Workers{
+		opt.Configuration.MaxWorkers = opt.Configuration.Workers
+	}
+	if opt.Configuration.TargetLatency == 0{
+		opt.Configuration.TargetLatency = 100
+	}
+	if opt.Configuration.InsertMethod == ""{
+		opt.Configuration.InsertMethod = "insert"
+	}
+	if opt.Configuration.PriorityLaneLength == 0{
+		opt.Configuration.PriorityLaneLength = opt.Configuration.QueueLength / 10
+		// a small queue still keeps some room for the priority spans
+		if opt.Configuration.PriorityLaneLength < 1{
+			opt.Configuration.PriorityLaneLength = 1
+		}
+	}
+	if opt.Configuration.NormalLaneLength == 0{
+		opt.Configuration.NormalLaneLength = opt.Configuration.QueueLength
+	}
+	if opt.Configuration.TailDecisionWait == 0{
+		opt.Configuration.TailDecisionWait = 10000
+	}
+	if opt.Configuration.TailMaxSpans == 0{
+		opt.Configuration.TailMaxSpans = 100000
+	}
+	if opt.Configuration.OverflowPolicy == ""{
+		opt.Configuration.OverflowPolicy = "drop-newest"
+	}
+	if opt.Configuration.Schema == ""{
+		opt.Configuration.Schema = "text"
+	}
+	if opt.Configuration.OverflowOperationName == ""{
+		opt.Configuration.OverflowOperationName = "_overflow_"
+	}
+}
+
+// splitList splits a comma separated flag, the empty items are skipped
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
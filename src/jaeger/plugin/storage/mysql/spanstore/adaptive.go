@@ -0,0 +1,175 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const adaptInterval = 5 * time.Second
+
+// adaptiveController tunes the batch size, the linger time and the number of active workers
+// from the insert latency and the queue depth observed during the last interval
+type adaptiveController struct {
+	minBatchSize  int64
+	maxBatchSize  int64
+	minWorkers    int64
+	maxWorkers    int64
+	targetLatency time.Duration
+	// scaleWorkers is off with trace affinity, a parked worker would strand its shard
+	scaleWorkers bool
+
+	// current values, read by the workers
+	batchSize     int64
+	lingerTime    int64
+	activeWorkers int64
+
+	// insert stats since the last adjustment
+	inserts      int64
+	insertNanos  int64
+	insertErrors int64
+}
+
+func newAdaptiveController(options BackgroudOptions, lingerTime time.Duration) *adaptiveController {
+	a := &adaptiveController{
+		minBatchSize:  int64(options.MinBatchsize),
+		maxBatchSize:  int64(options.MaxBatchsize),
+		minWorkers:    int64(options.MinWorkers),
+		maxWorkers:    int64(options.MaxWorkers),
+		targetLatency: time.Duration(options.TargetLatency) * time.Millisecond,
+		scaleWorkers:  !options.TraceAffinity,
+		lingerTime:    int64(lingerTime),
+	}
+	a.batchSize = clamp(int64(options.Batchsize), a.minBatchSize, a.maxBatchSize)
+	a.activeWorkers = clamp(int64(options.Workers), a.minWorkers, a.maxWorkers)
+	if !a.scaleWorkers {
+		a.activeWorkers = a.maxWorkers
+	}
+	return a
+}
+
+func (b *BackgroudStore) currentBatchSize() int {
+	if b.adaptive == nil {
+		return b.batchSize
+	}
+	return int(atomic.LoadInt64(&b.adaptive.batchSize))
+}
+
+func (b *BackgroudStore) currentLingerTime() time.Duration {
+	if b.adaptive == nil {
+		return b.lingerTime
+	}
+	return time.Duration(atomic.LoadInt64(&b.adaptive.lingerTime))
+}
+
+// parked reports whether the worker is idle because fewer workers are needed, never during shutdown
+func (b *BackgroudStore) parked(worker int) bool {
+	if b.adaptive == nil || !b.adaptive.scaleWorkers {
+		return false
+	}
+	select {
+	case <-b.done:
+		return false
+	default:
+	}
+	return int64(worker) >= atomic.LoadInt64(&b.adaptive.activeWorkers)
+}
+
+// recordInsert feeds the controller with the outcome of one insert
+func (b *BackgroudStore) recordInsert(latency time.Duration, err error) {
+	if b.adaptive == nil {
+		return
+	}
+	atomic.AddInt64(&b.adaptive.inserts, 1)
+	atomic.AddInt64(&b.adaptive.insertNanos, int64(latency))
+	if err != nil {
+		atomic.AddInt64(&b.adaptive.insertErrors, 1)
+	}
+}
+
+// adapt periodically grows the batches while inserts are fast and the queue is deep,
+// and shrinks them, as well as the number of active workers, on slow or failing inserts
+func (b *BackgroudStore) adapt() {
+	defer b.wg.Done()
+	a := b.adaptive
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+		inserts := atomic.SwapInt64(&a.inserts, 0)
+		insertNanos := atomic.SwapInt64(&a.insertNanos, 0)
+		insertErrors := atomic.SwapInt64(&a.insertErrors, 0)
+		var latency time.Duration
+		if inserts > 0 {
+			latency = time.Duration(insertNanos / inserts)
+		}
+		queued := b.queued()
+		batchSize, workers := a.next(atomic.LoadInt64(&a.batchSize), atomic.LoadInt64(&a.activeWorkers),
+			queued, inserts, latency, insertErrors)
+		// bigger batches take longer to fill
+		lingerTime := clamp(int64(b.lingerTime)*batchSize/int64(b.batchSize), int64(b.lingerTime)/2, int64(b.lingerTime)*4)
+
+		atomic.StoreInt64(&a.batchSize, batchSize)
+		atomic.StoreInt64(&a.lingerTime, lingerTime)
+		if a.scaleWorkers {
+			atomic.StoreInt64(&a.activeWorkers, workers)
+		}
+		b.batchSizeGauge.Update(batchSize)
+		b.lingerTimeGauge.Update(int64(time.Duration(lingerTime) / time.Millisecond))
+		b.activeWorkersGauge.Update(atomic.LoadInt64(&a.activeWorkers))
+		b.logger.Debug("adapt batching", zap.Int64("batchSize", batchSize), zap.Duration("lingerTime", time.Duration(lingerTime)),
+			zap.Int64("activeWorkers", atomic.LoadInt64(&a.activeWorkers)), zap.Duration("latency", latency),
+			zap.Int64("insertErrors", insertErrors), zap.Int64("queued", queued))
+	}
+}
+
+// next returns the batch size and the number of active workers of the next interval. The queue is deep
+// when more spans wait than the active workers take in one batch each, the queue capacity is far too
+// large to tell a backlog from its fill.
+func (a *adaptiveController) next(batchSize int64, workers int64, queued int64, inserts int64, latency time.Duration,
+	insertErrors int64) (int64, int64) {
+	round := workers * batchSize
+	switch {
+	case insertErrors > 0 || latency > 2*a.targetLatency:
+		batchSize = batchSize * 3 / 4
+		workers--
+	case inserts > 0 && latency < a.targetLatency && queued > round:
+		batchSize = batchSize*5/4 + 1
+		// several rounds behind, bigger batches alone are not enough
+		if queued > 4*round {
+			workers++
+		}
+	case queued < batchSize && latency < a.targetLatency:
+		workers--
+	}
+	return clamp(batchSize, a.minBatchSize, a.maxBatchSize), clamp(workers, a.minWorkers, a.maxWorkers)
+}
+
+func clamp(v int64, lo int64, hi int64) int64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
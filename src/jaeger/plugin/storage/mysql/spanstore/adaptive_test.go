@@ -0,0 +1,61 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveNext(t *testing.T) {
+	a := newAdaptiveController(BackgroudOptions{Batchsize: 100, MinBatchsize: 10, MaxBatchsize: 1000,
+		Workers: 4, MinWorkers: 1, MaxWorkers: 8, TargetLatency: 100}, time.Second)
+	fast, slow := 50*time.Millisecond, 300*time.Millisecond
+	for _, test := range []struct {
+		name          string
+		queued        int64
+		inserts       int64
+		latency       time.Duration
+		insertErrors  int64
+		wantBatchSize int64
+		wantWorkers   int64
+	}{
+		// a backlog is far below the 1e6 spans of a default queue capacity
+		{"one round behind grows the batches", 500, 10, fast, 0, 126, 4},
+		{"several rounds behind adds a worker", 2000, 10, fast, 0, 126, 5},
+		{"a round worth of spans is no backlog", 400, 10, fast, 0, 100, 4},
+		{"less than a batch parks a worker", 50, 10, fast, 0, 100, 3},
+		{"no insert keeps the batches", 500, 0, 0, 0, 100, 4},
+		{"slow inserts shrink", 2000, 10, slow, 0, 75, 3},
+		{"failing inserts shrink", 2000, 10, fast, 1, 75, 3},
+	} {
+		batchSize, workers := a.next(100, 4, test.queued, test.inserts, test.latency, test.insertErrors)
+		if batchSize != test.wantBatchSize || workers != test.wantWorkers {
+			t.Errorf("%s: got batch size %d and %d workers, want %d and %d", test.name, batchSize, workers,
+				test.wantBatchSize, test.wantWorkers)
+		}
+	}
+}
+
+func TestAdaptiveNextClamps(t *testing.T) {
+	a := newAdaptiveController(BackgroudOptions{Batchsize: 100, MinBatchsize: 80, MaxBatchsize: 110,
+		Workers: 2, MinWorkers: 2, MaxWorkers: 2, TargetLatency: 100}, time.Second)
+	if batchSize, workers := a.next(100, 2, 10000, 10, time.Millisecond, 0); batchSize != 110 || workers != 2 {
+		t.Errorf("grow: got batch size %d and %d workers, want 110 and 2", batchSize, workers)
+	}
+	if batchSize, workers := a.next(100, 2, 0, 10, time.Millisecond, 3); batchSize != 80 || workers != 2 {
+		t.Errorf("shrink: got batch size %d and %d workers, want 80 and 2", batchSize, workers)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+const (
+	// workerQueueLength is the capacity of a worker queue in batches, the eventQueue keeps buffering the rest
+	workerQueueLength = 4
+	// a worker queue fuller than this share of its capacity takes no more new traces
+	workerQueueHighWater = 0.75
+	queueDepthInterval   = time.Second
+)
+
+// workerQueueSize returns the capacity of a worker queue, sized for the largest batches
+// the adaptive batching may grow to
+func (b *BackgroudStore) workerQueueSize() int {
+	if b.adaptive != nil {
+		return workerQueueLength * int(b.adaptive.maxBatchSize)
+	}
+	return workerQueueLength * b.batchSize
+}
+
+// shard returns the worker all the spans of the trace are routed to
+func (b *BackgroudStore) shard(traceID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(traceID))
+	return int(h.Sum32() % uint32(len(b.workerQueues)))
+}
+
+// route moves the spans from the eventQueue to the worker queues by trace id.
+// When the worker of a trace is backed up, typically by one hot trace, the span goes
+// to the least loaded worker instead so the other traces of that worker are not starved.
+func (b *BackgroudStore) route() {
+	defer b.wg.Done()
+	defer func() {
+		for _, queue := range b.workerQueues {
+			close(queue)
+		}
+	}()
+	highWater := int(float64(b.workerQueueSize()) * workerQueueHighWater)
+	ticker := time.NewTicker(queueDepthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case span, ok := <-b.eventQueue:
+			if !ok {
+				return
+			}
+			queue := b.workerQueues[b.shard(span.TraceID)]
+			if len(queue) >= highWater {
+				queue = b.leastLoadedQueue()
+				b.affinityRerouteCount.Inc(1)
+			}
+			queue <- span
+		case <-ticker.C:
+			for i, queue := range b.workerQueues {
+				if i < len(b.workerQueueDepth) {
+					b.workerQueueDepth[i].Update(int64(len(queue)))
+				}
+			}
+		}
+	}
+}
+
+func (b *BackgroudStore) leastLoadedQueue() chan *dbmodel.Span {
+	least := b.workerQueues[0]
+	for _, queue := range b.workerQueues[1:] {
+		if len(queue) < len(least) {
+			least = queue
+		}
+	}
+	return least
+}
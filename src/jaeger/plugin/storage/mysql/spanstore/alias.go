@@ -0,0 +1,167 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	rewriteTracesService = "UPDATE traces SET service_name = ?, process = JSON_SET(process, '$.service_name', ?) " +
+		"WHERE service_name = ? LIMIT ?"
+	// the rows of the old service are read through the src derived table, the columns of the row already
+	// stored under the canonical name are qualified with the table name, unqualified they would be ambiguous
+	mergeOperationNames = "INSERT INTO operation_names (service_name, operation_name, span_kind, first_seen, last_seen, span_count) " +
+		"SELECT ?, src.operation_name, src.span_kind, src.first_seen, src.last_seen, src.span_count FROM " +
+		"(SELECT operation_name, span_kind, first_seen, last_seen, span_count FROM operation_names WHERE service_name = ?) AS src " +
+		"ON DUPLICATE KEY UPDATE first_seen = LEAST(operation_names.first_seen, src.first_seen), " +
+		"last_seen = GREATEST(operation_names.last_seen, src.last_seen), span_count = operation_names.span_count + src.span_count"
+	mergeServiceNames = "INSERT INTO service_names (service_name, first_seen, last_seen, span_count) " +
+		"SELECT ?, src.first_seen, src.last_seen, src.span_count FROM " +
+		"(SELECT first_seen, last_seen, span_count FROM service_names WHERE service_name = ?) AS src " +
+		"ON DUPLICATE KEY UPDATE first_seen = LEAST(service_names.first_seen, src.first_seen), " +
+		"last_seen = GREATEST(service_names.last_seen, src.last_seen), span_count = service_names.span_count + src.span_count"
+	deleteOperationNames = "DELETE FROM operation_names WHERE service_name = ?"
+	deleteServiceName    = "DELETE FROM service_names WHERE service_name = ?"
+)
+
+// ServiceAliases maps the old names of the renamed services to their canonical name. The spans are
+// written under the canonical name and a query of the canonical name also matches the old names.
+type ServiceAliases struct {
+	canonical map[string]string
+	// names holds the old names of every canonical name
+	names map[string][]string
+}
+
+// NewServiceAliases resolves the aliases, old name to new name. A new name may itself be renamed later on,
+// the old names then all map to the last one.
+func NewServiceAliases(aliases map[string]string) (*ServiceAliases, error) {
+	s := &ServiceAliases{canonical: map[string]string{}, names: map[string][]string{}}
+	for old := range aliases {
+		name, seen := old, map[string]struct{}{old: {}}
+		for {
+			next, ok := aliases[name]
+			if !ok {
+				break
+			}
+			if _, ok := seen[next]; ok {
+				return nil, fmt.Errorf("service alias %q loops back to %q", old, next)
+			}
+			seen[next] = struct{}{}
+			name = next
+		}
+		s.canonical[old] = name
+		s.names[name] = append(s.names[name], old)
+	}
+	for _, names := range s.names {
+		sort.Strings(names)
+	}
+	return s, nil
+}
+
+// Canonical returns the name a service is stored and listed under
+func (s *ServiceAliases) Canonical(service string) string {
+	if name, ok := s.canonical[service]; ok {
+		return name
+	}
+	return service
+}
+
+// Names returns the names the rows of a service may be stored under, its canonical name first
+func (s *ServiceAliases) Names(service string) []string {
+	service = s.Canonical(service)
+	return append([]string{service}, s.names[service]...)
+}
+
+// Rewrite returns the span with the canonical name of its service, or the span itself when the name
+// has no alias. The given span is not modified.
+func (s *ServiceAliases) Rewrite(span *model.Span) *model.Span {
+	name, ok := s.canonical[span.Process.ServiceName]
+	if !ok {
+		return span
+	}
+	process := *span.Process
+	process.ServiceName = name
+	rewritten := *span
+	rewritten.Process = &process
+	return &rewritten
+}
+
+// RewriteHistory moves the rows stored under the old names to their canonical name, the traces are
+// updated batchSize rows at a time. It returns the number of spans moved.
+func (s *ServiceAliases) RewriteHistory(db *sql.DB, batchSize int, logger *zap.Logger) (int64, error) {
+	var olds []string
+	for old := range s.canonical {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+	var total int64
+	for _, old := range olds {
+		name := s.canonical[old]
+		var spans int64
+		for {
+			result, err := db.Exec(rewriteTracesService, name, name, old, batchSize)
+			if err != nil {
+				return total, err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return total, err
+			}
+			spans += rows
+			total += rows
+			if rows < int64(batchSize) {
+				break
+			}
+			logger.Info("rewrite service alias", zap.String("service_name", old), zap.String("canonical", name),
+				zap.Int64("spans", spans))
+		}
+		if err := mergeNames(db, old, name); err != nil {
+			return total, err
+		}
+		logger.Info("rewrite service alias success", zap.String("service_name", old), zap.String("canonical", name),
+			zap.Int64("spans", spans))
+	}
+	return total, nil
+}
+
+// mergeNames merges the operations and the usage of the old service into the canonical one
+func mergeNames(db *sql.DB, old string, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{mergeOperationNames, []interface{}{name, old}},
+		{deleteOperationNames, []interface{}{old}},
+		{mergeServiceNames, []interface{}{name, old}},
+		{deleteServiceName, []interface{}{old}},
+	} {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
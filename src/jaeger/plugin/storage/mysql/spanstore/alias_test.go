@@ -0,0 +1,224 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// recordingDriver is a database/sql driver keeping the statements executed, in order
+type recordingDriver struct {
+	lock       sync.Mutex
+	statements []string
+	args       [][]interface{}
+	// rowsAffected is returned by the successive UPDATE statements, 0 once used up
+	rowsAffected []int64
+	// failOn fails the statements starting with it
+	failOn string
+	// fail, when set, returns the error of a statement from its arguments
+	fail func(query string, args []interface{}) error
+}
+
+func (d *recordingDriver) record(statement string, args []interface{}) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.statements = append(d.statements, statement)
+	d.args = append(d.args, args)
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{d}, nil
+}
+
+type recordingConn struct {
+	d *recordingDriver
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c.d, query}, nil
+}
+
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+func (c *recordingConn) Begin() (driver.Tx, error) {
+	c.d.record("BEGIN", nil)
+	return c, nil
+}
+
+func (c *recordingConn) Commit() error {
+	c.d.record("COMMIT", nil)
+	return nil
+}
+
+func (c *recordingConn) Rollback() error {
+	c.d.record("ROLLBACK", nil)
+	return nil
+}
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+func (s *recordingStmt) Close() error {
+	return nil
+}
+
+func (s *recordingStmt) NumInput() int {
+	return strings.Count(s.query, "?")
+}
+
+func (s *recordingStmt) Exec(values []driver.Value) (driver.Result, error) {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	s.d.record(s.query, args)
+	if s.d.failOn != "" && strings.HasPrefix(s.query, s.d.failOn) {
+		return nil, errors.New("exec failed")
+	}
+	if s.d.fail != nil {
+		if err := s.d.fail(s.query, args); err != nil {
+			return nil, err
+		}
+	}
+	var rows int64
+	if strings.HasPrefix(s.query, "UPDATE") {
+		s.d.lock.Lock()
+		if len(s.d.rowsAffected) > 0 {
+			rows, s.d.rowsAffected = s.d.rowsAffected[0], s.d.rowsAffected[1:]
+		}
+		s.d.lock.Unlock()
+	}
+	return driver.RowsAffected(rows), nil
+}
+
+func (s *recordingStmt) Query(values []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("query is not supported")
+}
+
+var recordingDrivers = struct {
+	sync.Mutex
+	n int
+}{}
+
+// openRecordingDB registers a new recordingDriver and opens a database on it
+func openRecordingDB(t *testing.T, d *recordingDriver) *sql.DB {
+	recordingDrivers.Lock()
+	recordingDrivers.n++
+	name := "recording" + strconv.Itoa(recordingDrivers.n)
+	recordingDrivers.Unlock()
+	sql.Register(name, d)
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestRewriteHistory(t *testing.T) {
+	aliases, err := NewServiceAliases(map[string]string{"old-cart": "cart"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &recordingDriver{rowsAffected: []int64{2, 1}}
+	db := openRecordingDB(t, d)
+	defer db.Close()
+
+	spans, err := aliases.RewriteHistory(db, 2, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spans != 3 {
+		t.Errorf("got %d spans, want 3", spans)
+	}
+	wantStatements := []string{rewriteTracesService, rewriteTracesService, "BEGIN", mergeOperationNames,
+		deleteOperationNames, mergeServiceNames, deleteServiceName, "COMMIT"}
+	if !reflect.DeepEqual(d.statements, wantStatements) {
+		t.Fatalf("statements\n got: %q\nwant: %q", d.statements, wantStatements)
+	}
+	wantArgs := [][]interface{}{
+		{"cart", "cart", "old-cart", int64(2)},
+		{"cart", "cart", "old-cart", int64(2)},
+		nil,
+		{"cart", "old-cart"},
+		{"old-cart"},
+		{"cart", "old-cart"},
+		{"old-cart"},
+		nil,
+	}
+	if !reflect.DeepEqual(d.args, wantArgs) {
+		t.Errorf("args\n got: %#v\nwant: %#v", d.args, wantArgs)
+	}
+}
+
+func TestRewriteHistoryRollback(t *testing.T) {
+	aliases, err := NewServiceAliases(map[string]string{"old-cart": "cart"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &recordingDriver{failOn: "DELETE FROM operation_names"}
+	db := openRecordingDB(t, d)
+	defer db.Close()
+
+	if _, err := aliases.RewriteHistory(db, 100, zap.NewNop()); err == nil {
+		t.Fatal("expected an error")
+	}
+	wantStatements := []string{rewriteTracesService, "BEGIN", mergeOperationNames, deleteOperationNames, "ROLLBACK"}
+	if !reflect.DeepEqual(d.statements, wantStatements) {
+		t.Errorf("statements\n got: %q\nwant: %q", d.statements, wantStatements)
+	}
+}
+
+// TestMergeNamesQualified checks the merge statements name the table of every usage column they update,
+// the target table is also the source of the INSERT ... SELECT and mysql rejects unqualified columns (1052)
+func TestMergeNamesQualified(t *testing.T) {
+	usageColumn := regexp.MustCompile(`(^|[^.\w])(first_seen|last_seen|span_count)\b`)
+	assignment := regexp.MustCompile(`(\w+) = (.*?)(, |$)`)
+	for table, query := range map[string]string{"operation_names": mergeOperationNames, "service_names": mergeServiceNames} {
+		parts := strings.SplitN(query, " ON DUPLICATE KEY UPDATE ", 2)
+		if len(parts) != 2 {
+			t.Fatalf("%s merge has no ON DUPLICATE KEY UPDATE: %s", table, query)
+		}
+		assignments := assignment.FindAllStringSubmatch(strings.Replace(parts[1], ", src.", ",src.", -1), -1)
+		if len(assignments) != 3 {
+			t.Fatalf("%s merge: got %d assignments in %q, want 3", table, len(assignments), parts[1])
+		}
+		for _, a := range assignments {
+			if match := usageColumn.FindString(a[2]); match != "" {
+				t.Errorf("%s merge: unqualified column %q in %q", table, strings.TrimSpace(match), a[0])
+			}
+			if !strings.Contains(a[2], table+"."+a[1]) || !strings.Contains(a[2], "src."+a[1]) {
+				t.Errorf("%s merge: %q does not combine the stored row and src", table, a[0])
+			}
+		}
+		if strings.Contains(query, "VALUES(") {
+			t.Errorf("%s merge uses VALUES(), refer to src instead: %s", table, query)
+		}
+	}
+}
@@ -18,6 +18,8 @@ package spanstore
 import (
 	"time"
 	"database/sql"
+	"sync"
+	"sync/atomic"
 	_ "strings"
 	"github.com/smartwalle/dbs"
 
@@ -30,56 +32,206 @@ import (
 type BackgroudStore struct{
 	mysql_client   			*sql.DB 
 	eventQueue     			chan *dbmodel.Span
+	spill          			*SpillQueue
+	// priority feeds the eventQueue when not nil
+	priority       			*PriorityQueue
+	retry          			RetryPolicy
+	deadLetter     			DeadLetterSink
 	logger         			*zap.Logger
 	lingerTime     			time.Duration
 	batchSize      			int
 	workers        			int
-	MysqlBatchInsertError   metrics.Counter
+	// idempotent skips the spans already stored instead of failing on the (trace_id, span_hash) unique key
+	idempotent     			bool
+	// loadData stores the batches with LOAD DATA LOCAL INFILE instead of INSERT
+	loadData       			bool
+	// promoted are the tags written to their own traces column when not nil
+	promoted       			*PromotedTags
+	// fullText writes the search_text column
+	fullText       			bool
+	// workerQueues shard the eventQueue by trace id when trace affinity is on
+	workerQueues   			[]chan *dbmodel.Span
+	// adaptive tunes the batching at runtime when not nil
+	adaptive       			*adaptiveController
+	BackgroudMetrics
+
+	// inFlight counts the spans taken off the eventQueue and not processed yet
+	inFlight       			int64
+	// maxAllowedPacket is the server max_allowed_packet, 0 until read
+	maxAllowedPacket		int64
+	wg             			sync.WaitGroup
+	done           			chan struct{}
+}
+
+type BackgroudMetrics struct {
+	batchInsertErrorCount   metrics.Counter
+	batchInsertRetryCount   metrics.Counter
+	deadLetterSpanCount     metrics.Counter
+	deadLetterErrorCount    metrics.Counter
+	// spanRejectedCount is keyed by the reject reason, see SpanRejectReasons
+	spanRejectedCount       map[string]metrics.Counter
+	// workerQueueDepth is indexed by worker, only reported with trace affinity
+	workerQueueDepth        []metrics.Gauge
+	affinityRerouteCount    metrics.Counter
+	// current values of the adaptive batching
+	batchSizeGauge          metrics.Gauge
+	lingerTimeGauge         metrics.Gauge
+	activeWorkersGauge      metrics.Gauge
+}
+
+func NewBackgroudMetrics(batchInsertErrorCounter metrics.Counter, batchInsertRetryCounter metrics.Counter,
+	deadLetterSpanCounter metrics.Counter, deadLetterErrorCounter metrics.Counter, spanRejectedCounters map[string]metrics.Counter,
+	workerQueueDepthGauges []metrics.Gauge, affinityRerouteCounter metrics.Counter,
+	batchSizeGauge metrics.Gauge, lingerTimeGauge metrics.Gauge, activeWorkersGauge metrics.Gauge) BackgroudMetrics{
+	return BackgroudMetrics{
+		batchInsertErrorCount: batchInsertErrorCounter,
+		batchInsertRetryCount: batchInsertRetryCounter,
+		deadLetterSpanCount: deadLetterSpanCounter,
+		deadLetterErrorCount: deadLetterErrorCounter,
+		spanRejectedCount: spanRejectedCounters,
+		workerQueueDepth: workerQueueDepthGauges,
+		affinityRerouteCount: affinityRerouteCounter,
+		batchSizeGauge: batchSizeGauge,
+		lingerTimeGauge: lingerTimeGauge,
+		activeWorkersGauge: activeWorkersGauge,
+	}
+}
+
+// BackgroudOptions tunes how the workers batch the spans
+type BackgroudOptions struct {
+	// LingerTime is in milliseconds
+	LingerTime    int
+	Batchsize     int
+	Workers       int
+	Idempotent    bool
+	// TraceAffinity routes all the spans of a trace to the same worker
+	TraceAffinity bool
+	// Adaptive moves the batch size and the number of active workers between the bounds below,
+	// TargetLatency is the insert latency in milliseconds above which batches stop growing
+	Adaptive      bool
+	MinBatchsize  int
+	MaxBatchsize  int
+	MinWorkers    int
+	MaxWorkers    int
+	TargetLatency int
+	// InsertMethod is InsertMethodInsert or InsertMethodLoadData, empty means insert
+	InsertMethod  string
+	// Promoted are the tags with a traces column of their own, nil for none
+	Promoted      *PromotedTags
+	// FullText writes the search_text column
+	FullText      bool
 }
 
-func NewBackgroudStore(client *sql.DB, ch chan *dbmodel.Span, logger *zap.Logger, lingerTime int, batch int, workers int, MysqlBatchInsertError metrics.Counter)*BackgroudStore{
-	return &BackgroudStore{
+func NewBackgroudStore(client *sql.DB, ch chan *dbmodel.Span, spill *SpillQueue, priority *PriorityQueue, retry RetryPolicy,
+	deadLetter DeadLetterSink, logger *zap.Logger, options BackgroudOptions, backgroudMetrics BackgroudMetrics)*BackgroudStore{
+	b := &BackgroudStore{
 		mysql_client: client,
 		eventQueue: ch, 
+		spill: spill,
+		priority: priority,
+		retry: retry,
+		deadLetter: deadLetter,
 		logger: logger,
-		lingerTime: time.Duration(uint64(lingerTime)) * time.Millisecond,
-		batchSize: batch,
-		workers: workers,
-		MysqlBatchInsertError: MysqlBatchInsertError,
+		lingerTime: time.Duration(uint64(options.LingerTime)) * time.Millisecond,
+		batchSize: options.Batchsize,
+		workers: options.Workers,
+		idempotent: options.Idempotent,
+		loadData: options.InsertMethod == InsertMethodLoadData,
+		promoted: options.Promoted,
+		fullText: options.FullText,
+		BackgroudMetrics: backgroudMetrics,
+		done: make(chan struct{}),
+	}
+	if options.Adaptive {
+		b.adaptive = newAdaptiveController(options, b.lingerTime)
+		// every worker up to the max is started, the extra ones are parked until needed
+		b.workers = options.MaxWorkers
+	}
+	if options.TraceAffinity {
+		for i := 0; i < b.workers; i++ {
+			b.workerQueues = append(b.workerQueues, make(chan *dbmodel.Span, b.workerQueueSize()))
+		}
+	}
+	return b
+}
+
+// queued returns the number of spans waiting for a worker
+func (b *BackgroudStore) queued() int64 {
+	queued := int64(len(b.eventQueue))
+	for _, queue := range b.workerQueues {
+		queued += int64(len(queue))
+	}
+	if b.priority != nil {
+		queued += int64(b.priority.Len())
 	}
+	return queued
 }
 
-// Close closes SpanWriter
-func (b BackgroudStore) Close() error {
-	b.mysql_client.Close()
-	return nil
+// capacity returns the number of spans that can wait for a worker
+func (b *BackgroudStore) capacity() int64 {
+	capacity := int64(cap(b.eventQueue))
+	if b.priority != nil {
+		capacity += int64(b.priority.Cap())
+	}
+	return capacity
+}
+
+// Shutdown waits at most timeout for the workers to flush the spans left in the eventQueue and in their batches,
+// the eventQueue must be closed first. It returns the number of spans flushed and the number of spans lost.
+func (b *BackgroudStore) Shutdown(timeout time.Duration) (int64, int64) {
+	close(b.done)
+	pending := b.queued() + atomic.LoadInt64(&b.inFlight)
+	finished := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		b.logger.Warn("storage workers did not finish before the shutdown timeout", zap.Duration("timeout", timeout))
+	}
+	lost := b.queued() + atomic.LoadInt64(&b.inFlight)
+	return pending - lost, lost
 }
 
-func (b BackgroudStore)Start(){
+func (b *BackgroudStore)Start(){
 	var (
 		eventQueue     = b.eventQueue
-		batchSize      = b.batchSize //default 50 
 		workers        = b.workers //default 8
-		lingerTime     = b.lingerTime // default 200 * time.Millisecond 
-		batchProcessor = func(batch []*dbmodel.Span) error {
+		batchProcessor = func(batch []*dbmodel.Span) {
 			if len(batch) > 0{
 				b.logger.Debug("process items", zap.Int("batch", len(batch)))
-				err := b.batch_insert(batch)
-				return err
+				b.insertBatch(batch)
 			}else{
 				b.logger.Debug("batch is 0")
 			}
-			return nil
-		}
-		errHandler = func(err error, batch []*dbmodel.Span) {
-			// TODO add metrics and alert
-			b.logger.Error("some error happens when batch insert", zap.Error(err))  
-			b.MysqlBatchInsertError.Inc(1)
 		}
 	)
 
+	b.refreshMaxPacket()
+	b.wg.Add(1)
+	go b.watchMaxPacket()
+
+	if len(b.workerQueues) > 0 {
+		b.wg.Add(1)
+		go b.route()
+	}
+
+	if b.adaptive != nil {
+		b.wg.Add(1)
+		go b.adapt()
+	}
+
 	for i := 0; i < workers; i++ {
+		worker := i
+		eventQueue := eventQueue
+		if len(b.workerQueues) > 0 {
+			eventQueue = b.workerQueues[i]
+		}
+		b.wg.Add(1)
 		go func() {
+			defer b.wg.Done()
 			var batch []*dbmodel.Span
 			lingerTimer := time.NewTimer(0)
 			if !lingerTimer.Stop() {
@@ -88,31 +240,47 @@ func (b BackgroudStore)Start(){
 			defer lingerTimer.Stop()
 
 			for {
+				if len(batch) == 0 && b.parked(worker) {
+					select {
+					case <-b.done:
+					case <-time.After(adaptInterval):
+					}
+					continue
+				}
 				select {
-				case msg := <-eventQueue:
+				case msg, ok := <-eventQueue:
+					if !ok {
+						// the queue is closed on shutdown, flush the last batch and quit
+						batchProcessor(batch)
+						atomic.AddInt64(&b.inFlight, -int64(len(batch)))
+						return
+					}
+					atomic.AddInt64(&b.inFlight, 1)
 					batch = append(batch, msg)
-					if len(batch) != batchSize {
+					if len(batch) < b.currentBatchSize() {
 						if len(batch) == 1 {
-							lingerTimer.Reset(lingerTime)
+							lingerTimer.Reset(b.currentLingerTime())
 						}
 						break
 					}
 
 					b.logger.Debug("batch is reach")
-					if err := batchProcessor(batch); err != nil {
-						errHandler(err, batch)
-					}
+					batchProcessor(batch)
+					atomic.AddInt64(&b.inFlight, -int64(len(batch)))
 
+					// the timer is not running when the batch was full with its first span, e.g. a batch size of 1
 					if !lingerTimer.Stop() {
-						<-lingerTimer.C
+						select {
+						case <-lingerTimer.C:
+						default:
+						}
 					}
 
 					batch = make([]*dbmodel.Span, 0)
 				case <-lingerTimer.C:
 					b.logger.Debug("time is reach")
-					if err := batchProcessor(batch); err != nil {
-						errHandler(err, batch)
-					}
+					batchProcessor(batch)
+					atomic.AddInt64(&b.inFlight, -int64(len(batch)))
 
 					batch = make([]*dbmodel.Span, 0)
 				}
@@ -120,18 +288,306 @@ func (b BackgroudStore)Start(){
 		}()
 		b.logger.Info("start storage worker success", zap.Int("worker",i))
 	}
+
+	if b.spill != nil {
+		b.wg.Add(1)
+		go b.drainSpill()
+		b.logger.Info("start spill drain worker success")
+	}
+}
+
+// drainSpill replays the spans spilled to disk once the eventQueue has room again
+func (b *BackgroudStore) drainSpill() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.lingerTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			// whatever is left stays on disk for the next run
+			return
+		case <-ticker.C:
+		}
+		// leave mysql to the workers while the in-memory queue is still backed up
+		for !b.spill.Empty() && b.queued() < b.capacity()/2 {
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+			spans, offset, err := b.spill.Peek(b.batchSize)
+			if err != nil {
+				b.logger.Error("read spill queue error", zap.Error(err))
+				break
+			}
+			if len(spans) == 0 {
+				break
+			}
+			stored := b.insertSpilled(spans)
+			if stored < len(spans) {
+				// mysql is not back yet, the spans left stay on disk until the next tick
+				b.batchInsertErrorCount.Inc(1)
+				if stored > 0 {
+					b.ackSpilled(stored)
+				}
+				break
+			}
+			b.spill.Ack(offset, len(spans))
+		}
+	}
+}
+
+// insertSpilled inserts the spans read from the spill queue, it returns how many of the first spans are
+// stored or rejected and can be acked. The spans of a chunk rejected for its data are isolated as in insertBatch.
+func (b *BackgroudStore) insertSpilled(spans []*dbmodel.Span) int {
+	chunks, oversize := b.splitBatch(spans)
+	done := make(map[*dbmodel.Span]bool, len(spans))
+	tooLarge := make(map[*dbmodel.Span]bool, len(oversize))
+	for _, span := range oversize {
+		done[span] = true
+		tooLarge[span] = true
+	}
+	for _, chunk := range chunks {
+		if err := b.batch_insert(chunk); err != nil {
+			if !isDataError(err) {
+				break
+			}
+			b.isolatePoisonSpans(err, chunk)
+		}
+		for _, span := range chunk {
+			done[span] = true
+		}
+	}
+	stored := 0
+	for stored < len(spans) && done[spans[stored]] {
+		// rejected only once acked, so that they are not rejected again on the next try
+		if tooLarge[spans[stored]] {
+			b.rejectSpan(b.spanTooLargeError(spans[stored]), spans[stored])
+		}
+		stored++
+	}
+	return stored
+}
+
+// ackSpilled acks the first n spans of the spill queue, the ones after them are read again on the next try
+func (b *BackgroudStore) ackSpilled(n int) {
+	_, offset, err := b.spill.Peek(n)
+	if err != nil {
+		b.logger.Error("read spill queue error", zap.Error(err))
+		return
+	}
+	b.spill.Ack(offset, n)
 }
 
-func (b BackgroudStore)batch_insert(spans []*dbmodel.Span) error{
+// insertBatch inserts a batch of the workers, split to fit in max_allowed_packet
+func (b *BackgroudStore) insertBatch(batch []*dbmodel.Span) {
+	chunks, oversize := b.splitBatch(batch)
+	for _, span := range oversize {
+		b.rejectSpan(b.spanTooLargeError(span), span)
+	}
+	for _, chunk := range chunks {
+		if err := b.insertWithRetry(chunk); err != nil {
+			b.handleBatchError(err, chunk)
+		}
+	}
+}
+
+// insertWithRetry inserts the batch, retrying the errors classified as transient by the retry policy
+func (b *BackgroudStore) insertWithRetry(batch []*dbmodel.Span) error {
+	for attempt := 0; ; attempt++ {
+		err := b.batch_insert(batch)
+		if err == nil {
+			return nil
+		}
+		if attempt+1 >= b.retry.Attempts || !isRetriableError(err) {
+			return err
+		}
+		backoff := b.retry.Backoff(attempt)
+		b.logger.Warn("retry batch insert", zap.Error(err), zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff))
+		b.batchInsertRetryCount.Inc(1)
+		time.Sleep(backoff)
+	}
+}
+
+// handleBatchError deals with a batch that still failed after all retries
+func (b *BackgroudStore) handleBatchError(err error, batch []*dbmodel.Span) {
+	if isDataError(err) {
+		b.isolatePoisonSpans(err, batch)
+		return
+	}
+	b.logger.Error("some error happens when batch insert", zap.Error(err))  
+	b.batchInsertErrorCount.Inc(1)
+	b.writeDeadLetter(batch, err)
+}
+
+// isolatePoisonSpans bisects a batch rejected because of its content until the offending spans are found,
+// the rest of the batch is inserted and only the offending spans are rejected. Data errors are never
+// retriable, so every half is tried once instead of going through the retry backoff at every level.
+func (b *BackgroudStore) isolatePoisonSpans(err error, batch []*dbmodel.Span) {
+	if len(batch) == 1 {
+		b.rejectSpan(err, batch[0])
+		return
+	}
+	first, second := batch[:len(batch)/2], batch[len(batch)/2:]
+	if err := b.batch_insert(first); err != nil {
+		b.handleBatchError(err, first)
+		// the second half may be clean as well as poisoned
+		if err := b.batch_insert(second); err != nil {
+			b.handleBatchError(err, second)
+		}
+		return
+	}
+	// the first half is clean, so the poison is in the second one
+	b.isolatePoisonSpans(err, second)
+}
+
+// rejectSpan reports a span mysql refuses to store and quarantines it in the dead letter sink
+func (b *BackgroudStore) rejectSpan(err error, span *dbmodel.Span) {
+	reason := spanRejectReason(err)
+	b.logger.Error("span rejected by mysql", zap.String("trace_id", span.TraceID), zap.Int64("span_id", span.SpanID),
+		zap.String("service_name", span.ServiceName), zap.String("operation_name", span.OperationName),
+		zap.String("reason", reason), zap.Error(err))
+	if counter, ok := b.spanRejectedCount[reason]; ok {
+		counter.Inc(1)
+	}
+	b.writeDeadLetter([]*dbmodel.Span{span}, err)
+}
+
+// InsertSync inserts the spans right away and returns the error of every span,
+// nothing is handed to the dead letter sink as the callers are told about the failures
+func (b *BackgroudStore) InsertSync(spans []*dbmodel.Span) []error {
+	errs := make([]error, len(spans))
+	position := make(map[*dbmodel.Span]int, len(spans))
+	for i, span := range spans {
+		position[span] = i
+	}
+	chunks, oversize := b.splitBatch(spans)
+	for _, span := range oversize {
+		if counter, ok := b.spanRejectedCount[packetTooLarge]; ok {
+			counter.Inc(1)
+		}
+		errs[position[span]] = b.spanTooLargeError(span)
+	}
+	for _, chunk := range chunks {
+		err := b.insertWithRetry(chunk)
+		if err == nil {
+			continue
+		}
+		b.batchInsertErrorCount.Inc(1)
+		if isDataError(err) && len(chunk) > 1 {
+			// find out which spans are to blame instead of failing all of them
+			for _, span := range chunk {
+				errs[position[span]] = b.batch_insert([]*dbmodel.Span{span})
+			}
+			continue
+		}
+		for _, span := range chunk {
+			errs[position[span]] = err
+		}
+	}
+	return errs
+}
+
+// writeDeadLetter hands a batch that can not be stored to the dead letter sink
+func (b *BackgroudStore) writeDeadLetter(batch []*dbmodel.Span, err error) {
+	if b.deadLetter == nil {
+		return
+	}
+	letter := &DeadLetter{
+		CreatedAt: time.Now().UnixNano() / 1000,
+		ErrorCode: mysqlErrorNumber(err),
+		Error:     err.Error(),
+		Spans:     batch,
+	}
+	if err := b.deadLetter.Write(letter); err != nil {
+		b.logger.Error("write dead letter error", zap.Error(err), zap.Int("spans", len(batch)))
+		b.deadLetterErrorCount.Inc(1)
+		return
+	}
+	b.deadLetterSpanCount.Inc(int64(len(batch)))
+}
+
+// ReplayDeadLetters inserts the batches kept by the dead letter sink back into the traces table
+func (b *BackgroudStore) ReplayDeadLetters() (int, error) {
+	if b.deadLetter == nil {
+		return 0, nil
+	}
+	b.refreshMaxPacket()
+	return b.deadLetter.Replay(func(letter *DeadLetter) error {
+		chunks, oversize := b.splitBatch(letter.Spans)
+		if len(oversize) > 0 {
+			b.logger.Warn("skip dead letter with spans exceeding max_allowed_packet", zap.Int("spans", len(letter.Spans)),
+				zap.Int("oversize", len(oversize)))
+			return ErrKeepDeadLetter
+		}
+		for _, chunk := range chunks {
+			err := b.insertWithRetry(chunk)
+			if isDataError(err) {
+				// quarantined spans are kept for a human to look at
+				b.logger.Warn("skip dead letter rejected by mysql", zap.Error(err), zap.Int("spans", len(letter.Spans)))
+				return ErrKeepDeadLetter
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// batch_insert stores the spans, and their span_tags rows in the same transaction: a retry after
+// a span_tags error must not find the spans already stored
+func (b *BackgroudStore)batch_insert(spans []*dbmodel.Span) error{
+	if !hasIndexTags(spans) {
+		return b.insertSpans(b.mysql_client, spans)
+	}
+	tx, err := b.mysql_client.Begin()
+	if err != nil {
+		return err
+	}
+	if err := b.insertSpans(tx, spans); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := b.insertTags(tx, spans); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertSpans stores the spans in traces with the configured insert method
+func (b *BackgroudStore) insertSpans(db dbs.Executor, spans []*dbmodel.Span) error {
+	if b.loadData {
+		return b.batch_load(db, spans)
+	}
+	return b.insert_traces(db, spans)
+}
+
+func (b *BackgroudStore)insert_traces(db dbs.Executor, spans []*dbmodel.Span) error{
 	var ib = dbs.NewInsertBuilder()
     ib.Table("traces")
-    ib.Columns("trace_id", "span_id", "span_hash", "parent_id", "operation_name", "flags",
-		"start_time", "duration", "tags", "logs", "refs", "process", "service_name", "http_code", "error")
+    ib.Columns(b.columns()...)
 	for _, span := range spans {
-		ib.Values(span.TraceID, span.SpanID,span.SpanHash, span.ParentID, span.OperationName, span.Flags, span.StartTime,
-			span.Duration, span.Tags, span.Logs, span.Refs, span.Process, span.ServiceName, span.HttpCode, span.Error)
+		values := []interface{}{span.TraceID, span.SpanID,span.SpanHash, span.ParentID, span.OperationName, span.Flags, span.StartTime,
+			span.Duration, span.Tags, span.Logs, span.Refs, span.Process, span.ServiceName, span.HttpCode, span.Error, span.SpanKind}
+		if b.promoted != nil {
+			for _, key := range b.promoted.Keys() {
+				values = append(values, span.PromotedTags[key])
+			}
+		}
+		if b.fullText {
+			values = append(values, span.SearchText)
+		}
+		ib.Values(values...)
+	}
+	if b.idempotent {
+		// replays and retries hit the (trace_id, span_hash) unique key, keep the stored row
+		ib.Suffix("ON DUPLICATE KEY UPDATE span_hash=span_hash")
 	}
-	_, err := ib.Exec(b.mysql_client)
+	start := time.Now()
+	_, err := ib.Exec(db)
+	b.recordInsert(time.Since(start), err)
 	if err != nil {
 		sql, _,_ := ib.ToSQL()
 		b.logger.Error("batch insert error", zap.Error(err), zap.String("sql", sql))			
@@ -0,0 +1,103 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+	"github.com/uber/jaeger-lib/metrics"
+	"go.uber.org/zap"
+)
+
+// recordingDeadLetterSink keeps the letters written in memory
+type recordingDeadLetterSink struct {
+	letters []*DeadLetter
+}
+
+func (s *recordingDeadLetterSink) Write(letter *DeadLetter) error {
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+func (s *recordingDeadLetterSink) Replay(fn func(letter *DeadLetter) error) (int, error) {
+	return 0, nil
+}
+
+// insertedSpanIDs returns the span ids of an INSERT INTO traces statement
+func insertedSpanIDs(args []interface{}) []int64 {
+	var spanIDs []int64
+	for i := 1; i < len(args); i += len(traceColumns) {
+		spanIDs = append(spanIDs, args[i].(int64))
+	}
+	return spanIDs
+}
+
+// TestIsolatePoisonSpans checks the bisection tries every half once: the poisoned span is rejected alone,
+// and a half failing with a retriable error goes to the dead letter sink without a retry
+func TestIsolatePoisonSpans(t *testing.T) {
+	d := &recordingDriver{fail: func(query string, args []interface{}) error {
+		spanIDs := insertedSpanIDs(args)
+		for _, spanID := range spanIDs {
+			if spanID == 5 {
+				return &mysql.MySQLError{Number: 1406, Message: "Data too long for column 'operation_name'"}
+			}
+		}
+		if reflect.DeepEqual(spanIDs, []int64{0, 1, 2, 3}) {
+			return &mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}
+		}
+		return nil
+	}}
+	db := openRecordingDB(t, d)
+	defer db.Close()
+	deadLetter := &recordingDeadLetterSink{}
+	backgroudMetrics := NewBackgroudMetrics(metrics.NullCounter, metrics.NullCounter, metrics.NullCounter,
+		metrics.NullCounter, nil, nil, metrics.NullCounter, metrics.NullGauge, metrics.NullGauge, metrics.NullGauge)
+	store := NewBackgroudStore(db, nil, nil, nil, NewRetryPolicy(3, 1, 1), deadLetter, zap.NewNop(),
+		BackgroudOptions{Batchsize: 8}, backgroudMetrics)
+
+	batch := make([]*dbmodel.Span, 8)
+	for i := range batch {
+		batch[i] = &dbmodel.Span{TraceID: "trace", SpanID: int64(i)}
+	}
+	store.insertBatch(batch)
+
+	var inserts [][]int64
+	for i, statement := range d.statements {
+		if strings.Contains(statement, "INTO traces ") {
+			inserts = append(inserts, insertedSpanIDs(d.args[i]))
+		}
+	}
+	wantInserts := [][]int64{{0, 1, 2, 3, 4, 5, 6, 7}, {0, 1, 2, 3}, {4, 5, 6, 7}, {4, 5}, {4}, {6, 7}}
+	if !reflect.DeepEqual(inserts, wantInserts) {
+		t.Errorf("inserts\n got: %v\nwant: %v", inserts, wantInserts)
+	}
+
+	var letters [][]int64
+	for _, letter := range deadLetter.letters {
+		var spanIDs []int64
+		for _, span := range letter.Spans {
+			spanIDs = append(spanIDs, span.SpanID)
+		}
+		letters = append(letters, spanIDs)
+	}
+	wantLetters := [][]int64{{0, 1, 2, 3}, {5}}
+	if !reflect.DeepEqual(letters, wantLetters) {
+		t.Errorf("dead letters\n got: %v\nwant: %v", letters, wantLetters)
+	}
+}
@@ -18,9 +18,22 @@ package spanstore
 import (
 	"database/sql"
 	"sync"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/smartwalle/dbs"
+	"github.com/uber/jaeger-lib/metrics"
 	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+const (
+	cacheFlushInterval = time.Second
+	// cacheFlushBatch is the max rows of one cache insert
+	cacheFlushBatch = 500
+	// maxLoggedOverflowNames is how many collapsed operation names are logged per service
+	maxLoggedOverflowNames = 10
 )
 
 
@@ -28,89 +41,319 @@ const (
 	insertSpan = `INSERT INTO traces(trace_id, span_id, span_hash, parent_id, operation_name, flags,
 				    start_time, duration, tags, logs, refs, process, service_name)
 					VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-	insertServiceName = `INSERT ignore INTO service_names(service_name) VALUES (?)`
-	insertOperationName = `INSERT ignore  INTO operation_names(service_name, operation_name) VALUES (?, ?)`
-	queryTraceByTraceId = `SELECT trace_id,span_id,parent_id,operation_name,flags,start_time,duration,tags,logs,refs,process FROM traces where trace_id = ?`
-	queryTraceByTraceIds = "SELECT trace_id,span_id,parent_id,operation_name,flags,start_time,duration,tags,logs,refs,process FROM traces where trace_id in "
-	queryServiceNames = `SELECT service_name FROM service_names`
-	queryOperationsByServiceName = `SELECT operation_name FROM operation_names where service_name = ?`
+	queryTraceByTraceId = `SELECT trace_id,span_id,span_hash,parent_id,operation_name,flags,start_time,duration,tags,logs,refs,process FROM traces where trace_id = ?`
+	queryTraceByTraceIds = "SELECT trace_id,span_id,span_hash,parent_id,operation_name,flags,start_time,duration,tags,logs,refs,process FROM traces where trace_id in "
+	queryServiceNames = `SELECT service_name FROM service_names where last_seen >= ?`
+	queryOperationsByServiceName = `SELECT operation_name, span_kind FROM operation_names where service_name = ? and last_seen >= ?`
+	deleteStaleServiceNames = `DELETE FROM service_names where last_seen < ?`
+	deleteStaleOperationNames = `DELETE FROM operation_names where last_seen < ?`
+	// first_seen is only set by the insert, span_count adds up the spans seen since the last flush
+	upsertUsage = "ON DUPLICATE KEY UPDATE last_seen = GREATEST(last_seen, VALUES(last_seen)), span_count = span_count + VALUES(span_count)"
 )
 
-// CacheStore 
+type cacheEntry struct {
+	service   string
+	operation string
+	spanKind  string
+}
+
+type cacheUsage struct {
+	cacheEntry
+	count int64
+}
+
+// operationKey is an operation of a service, the same name may be used by several span kinds
+type operationKey struct {
+	name     string
+	spanKind string
+}
+
+// CacheOptions describes what the CacheStore keeps
+type CacheOptions struct {
+	// Retention hides and prunes the entries not seen for that long, 0 keeps them forever
+	Retention               time.Duration
+	// MaxOperationsPerService caps the operations of a service, one per name and span kind, 0 for no cap.
+	// The new operations beyond it are renamed OverflowOperationName.
+	MaxOperationsPerService int
+	OverflowOperationName   string
+}
+
+// CacheStore keeps the known services and operations in memory. How often they are seen is written
+// to service_names and operation_names in the background so that writers never wait for mysql.
 type CacheStore struct {
 	mysql_client  *sql.DB
-	caches        map[string]map[string]struct{}
+	caches        map[string]map[operationKey]struct{}
+	// usage counts the spans of every entry since the last flush, guarded by cacheLock
+	usage         map[cacheEntry]int64
 	cacheLock     sync.Mutex
+	retry         RetryPolicy
+	options       CacheOptions
 	logger        *zap.Logger
+	flushErrorCount metrics.Counter
+	// operationOverflowCount returns the counter of the operations renamed for a service, guarded by cacheLock
+	operationOverflowCount func(service string) metrics.Counter
+	overflowCounters       map[string]metrics.Counter
+	// overflowNames holds the first collapsed operation names of each service, guarded by cacheLock
+	overflowNames          map[string]map[string]struct{}
+
+	done          chan struct{}
+	closeOnce     sync.Once
+	wg            sync.WaitGroup
 }
 
-// Close closes SpanWriter
+// Close stops the background writes after writing the pending entries, the mysql client is left open
 func (c *CacheStore) Close() error {
-	c.mysql_client.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+		c.flush()
+	})
 	return nil
 }
 
 // NewCacheStore 
-func NewCacheStore(mysql_client *sql.DB, logger *zap.Logger) *CacheStore {
+func NewCacheStore(mysql_client *sql.DB, retry RetryPolicy, options CacheOptions, logger *zap.Logger,
+	flushErrorCounter metrics.Counter, operationOverflowCounter func(service string) metrics.Counter) *CacheStore {
 	return &CacheStore{
 		mysql_client: mysql_client, 
-		caches: map[string]map[string]struct{}{},
+		caches: map[string]map[operationKey]struct{}{},
+		usage: map[cacheEntry]int64{},
+		retry: retry,
+		options: options,
 		logger: logger,
+		flushErrorCount: flushErrorCounter,
+		operationOverflowCount: operationOverflowCounter,
+		overflowCounters: map[string]metrics.Counter{},
+		overflowNames: map[string]map[string]struct{}{},
+		done: make(chan struct{}),
 	}
 }
 
+// Initialize loads the caches from mysql and starts writing the new entries in the background
 func (c *CacheStore)Initialize(){
 	c.load_caches()
+	c.wg.Add(1)
+	go c.flushLoop()
 }
 
 func (c *CacheStore)load_caches(){
-	c.cacheLock.Lock()
-	defer c.cacheLock.Unlock()
 	service_names, err := c.LoadServices()
 	if err != nil {
 		c.logger.Error("getServices error", zap.Error(err))
 		return 
 	}
+	caches := map[string]map[operationKey]struct{}{}
 	for _, service_name := range service_names {
-		c.caches[service_name] = map[string]struct{}{}
-		operation_names, err := c.LoadOperations(service_name)
+		caches[service_name] = map[operationKey]struct{}{}
+		operations, err := c.LoadOperations(spanstore.OperationQueryParameters{ServiceName: service_name})
 		if err != nil {
 			c.logger.Error("get service operation error", zap.Error(err))
 			continue 
 		}
-		for _, operation_name := range operation_names{
-			c.caches[service_name][operation_name] = struct{}{}
+		for _, operation := range operations{
+			caches[service_name][operationKey{name: operation.Name, spanKind: operation.SpanKind}] = struct{}{}
+		}
+	}
+
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	// the entries seen since the last flush may not be stored yet
+	for entry := range c.usage {
+		if _, ok := caches[entry.service]; !ok {
+			caches[entry.service] = map[operationKey]struct{}{}
 		}
+		caches[entry.service][operationKey{name: entry.operation, spanKind: entry.spanKind}] = struct{}{}
 	}
-	c.logger.Info("load caches success", zap.Any("caches", c.caches))
+	c.caches = caches
+	c.logger.Info("load caches success", zap.Int("services", len(caches)))
 }
 
-func (c *CacheStore) UpdateCaches(service string, operation string){
+// cutoff returns the last_seen below which the entries are stale, in microseconds
+func (c *CacheStore) cutoff() int64 {
+	if c.options.Retention <= 0 {
+		return 0
+	}
+	return time.Now().Add(-c.options.Retention).UnixNano() / 1000
+}
+
+// Prune deletes the services and operations not seen within the retention period
+func (c *CacheStore) Prune() error {
+	cutoff := c.cutoff()
+	if cutoff == 0 {
+		return nil
+	}
+	operations, err := c.mysql_client.Exec(deleteStaleOperationNames, cutoff)
+	if err != nil {
+		return err
+	}
+	services, err := c.mysql_client.Exec(deleteStaleServiceNames, cutoff)
+	if err != nil {
+		return err
+	}
+	prunedOperations, _ := operations.RowsAffected()
+	prunedServices, _ := services.RowsAffected()
+	if prunedOperations > 0 || prunedServices > 0 {
+		c.logger.Info("prune stale services and operations", zap.Int64("services", prunedServices),
+			zap.Int64("operations", prunedOperations))
+		c.load_caches()
+	}
+	return nil
+}
+
+// UpdateCaches records the service and operation of a span, mysql is written later by the flusher.
+// It returns the operation name to store, the overflow name when the service has too many operations.
+func (c *CacheStore) UpdateCaches(service string, operation string, spanKind string) string {
 	c.cacheLock.Lock()
 	defer c.cacheLock.Unlock()
 	service_operations, ok := c.caches[service]
 	if !ok {
-		c.caches[service] = map[string]struct{}{}
-		c.caches[service][operation] = struct{}{}
-		// insert service operation to mysql
-		_, err := c.mysql_client.Exec(insertServiceName, service)
-		if err != nil {
-			c.logger.Error("write service_name err", zap.Error(err))
+		service_operations = map[operationKey]struct{}{}
+		c.caches[service] = service_operations
+	}
+	key := operationKey{name: operation, spanKind: spanKind}
+	if _, ok := service_operations[key]; !ok{
+		if c.options.MaxOperationsPerService > 0 && len(service_operations) >= c.options.MaxOperationsPerService &&
+			operation != c.options.OverflowOperationName {
+			c.collapse(service, operation)
+			operation = c.options.OverflowOperationName
+			key.name = operation
 		}
-	}else{
-		if _, ok := service_operations[operation]; !ok{
-			c.caches[service][operation] = struct{}{}
-			// insert operation to mysql
-			_, err := c.mysql_client.Exec(insertOperationName, service, operation)
-			if err != nil {
-				c.logger.Error("write operation_name err", zap.Error(err))
+		service_operations[key] = struct{}{}
+	}
+	c.usage[cacheEntry{service: service, operation: operation, spanKind: spanKind}]++
+	return operation
+}
+
+// collapse accounts an operation renamed to the overflow name. The lock must be held.
+func (c *CacheStore) collapse(service string, operation string) {
+	counter, ok := c.overflowCounters[service]
+	if !ok {
+		counter = c.operationOverflowCount(service)
+		c.overflowCounters[service] = counter
+	}
+	counter.Inc(1)
+
+	names, ok := c.overflowNames[service]
+	if !ok {
+		names = map[string]struct{}{}
+		c.overflowNames[service] = names
+		c.logger.Warn("too many operations, new operations are stored as the overflow operation",
+			zap.String("service_name", service), zap.Int("maxOperationsPerService", c.options.MaxOperationsPerService),
+			zap.String("overflow_operation", c.options.OverflowOperationName))
+	}
+	if _, ok := names[operation]; ok || len(names) >= maxLoggedOverflowNames {
+		return
+	}
+	names[operation] = struct{}{}
+	c.logger.Warn("operation collapsed into the overflow operation", zap.String("service_name", service),
+		zap.String("operation_name", operation))
+}
+
+func (c *CacheStore) flushLoop() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(cacheFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.flush()
+		}
+	}
+}
+
+// flush writes the usage of the entries seen since the last flush, the failed ones are kept for the next flush
+func (c *CacheStore) flush() {
+	c.cacheLock.Lock()
+	usage := c.usage
+	c.usage = map[cacheEntry]int64{}
+	c.cacheLock.Unlock()
+
+	entries := make([]cacheUsage, 0, len(usage))
+	for entry, count := range usage {
+		entries = append(entries, cacheUsage{cacheEntry: entry, count: count})
+	}
+	var failed []cacheUsage
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > cacheFlushBatch {
+			n = cacheFlushBatch
+		}
+		batch := entries[:n]
+		entries = entries[n:]
+		err := c.insertWithRetry(batch)
+		if err == nil {
+			continue
+		}
+		c.flushErrorCount.Inc(1)
+		if !isDataError(err) {
+			c.logger.Error("write service and operation names error", zap.Error(err), zap.Int("entries", len(batch)))
+			failed = append(failed, batch...)
+			continue
+		}
+		// some names are refused, e.g. too long, write the others one by one
+		for _, entry := range batch {
+			if err := c.insertWithRetry([]cacheUsage{entry}); err != nil {
+				c.logger.Error("write service and operation name error", zap.Error(err),
+					zap.String("service_name", entry.service), zap.String("operation_name", entry.operation))
+				if !isDataError(err) {
+					failed = append(failed, entry)
+				}
 			}
 		}
 	}
+	if len(failed) > 0 {
+		c.cacheLock.Lock()
+		for _, entry := range failed {
+			c.usage[entry.cacheEntry] += entry.count
+		}
+		c.cacheLock.Unlock()
+	}
 }
 
+func (c *CacheStore) insertWithRetry(entries []cacheUsage) error {
+	for attempt := 0; ; attempt++ {
+		err := c.insertEntries(entries)
+		if err == nil || attempt+1 >= c.retry.Attempts || !isRetriableError(err) {
+			return err
+		}
+		time.Sleep(c.retry.Backoff(attempt))
+	}
+}
+
+func (c *CacheStore) insertEntries(entries []cacheUsage) error {
+	now := time.Now().UnixNano() / 1000
+	var serviceNames []string
+	serviceCounts := map[string]int64{}
+	operations := dbs.NewInsertBuilder()
+	operations.Table("operation_names")
+	operations.Columns("service_name", "operation_name", "span_kind", "first_seen", "last_seen", "span_count")
+	for _, entry := range entries {
+		if _, ok := serviceCounts[entry.service]; !ok {
+			serviceNames = append(serviceNames, entry.service)
+		}
+		serviceCounts[entry.service] += entry.count
+		operations.Values(entry.service, entry.operation, entry.spanKind, now, now, entry.count)
+	}
+	operations.Suffix(upsertUsage)
+	services := dbs.NewInsertBuilder()
+	services.Table("service_names")
+	services.Columns("service_name", "first_seen", "last_seen", "span_count")
+	for _, service := range serviceNames {
+		services.Values(service, now, now, serviceCounts[service])
+	}
+	services.Suffix(upsertUsage)
+	if _, err := services.Exec(c.mysql_client); err != nil {
+		return err
+	}
+	_, err := operations.Exec(c.mysql_client)
+	return err
+}
+
+// LoadServices returns the services seen within the retention period
 func (c *CacheStore)LoadServices()([]string, error){
-	rows, err := c.mysql_client.Query(queryServiceNames)
+	rows, err := c.mysql_client.Query(queryServiceNames, c.cutoff())
 	if err != nil {
 		c.logger.Error("queryService err", zap.Error(err))
 		return nil, err
@@ -128,21 +371,27 @@ func (c *CacheStore)LoadServices()([]string, error){
 	return service_names, nil
 }
 
-func (c *CacheStore) LoadOperations(service string) ([]string, error){
-	rows, err := c.mysql_client.Query(queryOperationsByServiceName, service)
+func (c *CacheStore) LoadOperations(query spanstore.OperationQueryParameters) ([]spanstore.Operation, error){
+	stmt := queryOperationsByServiceName
+	args := []interface{}{query.ServiceName, c.cutoff()}
+	if query.SpanKind != "" {
+		stmt += " and span_kind = ?"
+		args = append(args, query.SpanKind)
+	}
+	rows, err := c.mysql_client.Query(stmt, args...)
 	if err != nil {
 		c.logger.Error("queryOperation err", zap.Error(err))
 		return nil, err
 	}
 	defer rows.Close()
-	var operation_names []string
-	var operation_name string
+	var operations []spanstore.Operation
 	for rows.Next() {
-		err := rows.Scan(&operation_name)
+		var operation spanstore.Operation
+		err := rows.Scan(&operation.Name, &operation.SpanKind)
 		if err != nil {
 			c.logger.Error("queryService scan err", zap.Error(err))
 		}
-		operation_names = append(operation_names, operation_name)
+		operations = append(operations, operation)
 	}
-	return operation_names, nil
+	return operations, nil
 }
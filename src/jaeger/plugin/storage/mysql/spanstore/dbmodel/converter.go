@@ -145,6 +145,7 @@ func (c converter) fromDomain(span *model.Span) *Span {
 	spanHash, _ := model.HashCode(span)
 	http_code_tag := getHttpCode(span.Tags)
 	error_tag := getError(span.Tags)
+	span_kind_tag := getSpanKind(span.Tags)
 
 	return &Span{
 		TraceID:       span.TraceID.String(),
@@ -162,6 +163,7 @@ func (c converter) fromDomain(span *model.Span) *Span {
 		ServiceName:   span.Process.ServiceName,
 		HttpCode:      http_code_tag,
 		Error:         error_tag,
+		SpanKind:      span_kind_tag,
 	}
 }
 
@@ -174,6 +176,16 @@ func getHttpCode(tags []model.KeyValue) int64{
 	return 0
 }
 
+// getSpanKind returns the span.kind tag: server, client, producer, consumer or empty
+func getSpanKind(tags []model.KeyValue) string{
+	for _, tag := range tags {
+		if tag.GetKey() == "span.kind" {
+			return tag.AsString()
+		}
+	}
+	return ""
+}
+
 func getError(tags []model.KeyValue) bool{
 	for _, tag := range tags {
 		if tag.GetKey() == "error" {
@@ -54,6 +54,19 @@ type Span struct {
 	ServiceName   string  `db:"service_name"`
 	HttpCode      int64   `db:"http_code"`
 	Error         bool    `db:"error"`
+	SpanKind      string  `db:"span_kind"`
+	// IndexTags are not a traces column, they are written to span_tags
+	IndexTags     []IndexTag
+	// PromotedTags are the values of the promoted tags by key, written to their tag_ columns
+	PromotedTags  map[string]string
+	// SearchText holds the tag and log values, only written when full-text search is on
+	SearchText    string  `db:"search_text"`
+}
+
+// IndexTag is a span or process tag searchable through span_tags
+type IndexTag struct {
+	Key   string
+	Value string
 }
 
 // SpanRef is the UDT representation of a Jaeger Span Reference.
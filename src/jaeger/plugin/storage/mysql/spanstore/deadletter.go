@@ -0,0 +1,255 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+const (
+	DeadLetterTable = "table"
+	DeadLetterFile  = "file"
+	// DefaultDeadLetterFallback is the file taking the letters the table sink could not write
+	DefaultDeadLetterFallback = "traces_dead_letter.json"
+
+	insertDeadLetter = `INSERT INTO traces_dead_letter(created_at, error_code, error, span_count, batch) VALUES (?, ?, ?, ?, ?)`
+	queryDeadLetters = `SELECT id, created_at, error_code, error, batch FROM traces_dead_letter WHERE id > ? ORDER BY id LIMIT 100`
+	deleteDeadLetter = `DELETE FROM traces_dead_letter WHERE id = ?`
+)
+
+// ErrKeepDeadLetter is returned by a replay callback to keep the letter and go on with the next one
+var ErrKeepDeadLetter = errors.New("keep dead letter")
+
+// DeadLetter is a batch that could not be stored, kept together with the reason
+type DeadLetter struct {
+	CreatedAt int64           `json:"created_at"`
+	ErrorCode uint16          `json:"error_code"`
+	Error     string          `json:"error"`
+	Spans     []*dbmodel.Span `json:"spans"`
+}
+
+// DeadLetterSink keeps the batches that failed after all retries so they can be replayed later
+type DeadLetterSink interface {
+	Write(letter *DeadLetter) error
+	// Replay calls fn for every stored letter, oldest first, and removes the letters fn accepted.
+	// It stops at the first letter fn rejects, unless fn returns ErrKeepDeadLetter,
+	// and returns the number of replayed letters.
+	Replay(fn func(letter *DeadLetter) error) (int, error)
+}
+
+// NewDeadLetterSink creates the sink of the given kind, nil when kind is empty. With the table kind,
+// path is the fallback file of the letters the table could not take, DefaultDeadLetterFallback when empty.
+func NewDeadLetterSink(kind string, db *sql.DB, path string) (DeadLetterSink, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case DeadLetterTable:
+		if path == "" {
+			path = DefaultDeadLetterFallback
+		}
+		return &tableDeadLetterSink{mysql_client: db, fallback: &fileDeadLetterSink{path: path}}, nil
+	case DeadLetterFile:
+		if path == "" {
+			return nil, fmt.Errorf("dead letter file path is required")
+		}
+		return &fileDeadLetterSink{path: path}, nil
+	}
+	return nil, fmt.Errorf("unknown dead letter sink %q", kind)
+}
+
+// tableDeadLetterSink stores the letters in the traces_dead_letter table. The batches failing for another
+// reason than their data usually come from a mysql outage, which fails the table as well: these letters
+// go to the fallback file and are replayed after the table ones.
+type tableDeadLetterSink struct {
+	mysql_client *sql.DB
+	fallback     *fileDeadLetterSink
+}
+
+func (s *tableDeadLetterSink) Write(letter *DeadLetter) error {
+	batch, err := json.Marshal(letter.Spans)
+	if err != nil {
+		return err
+	}
+	_, err = s.mysql_client.Exec(insertDeadLetter, letter.CreatedAt, letter.ErrorCode, letter.Error, len(letter.Spans), string(batch))
+	if err == nil {
+		return nil
+	}
+	if fallbackErr := s.fallback.Write(letter); fallbackErr != nil {
+		return fmt.Errorf("%v, fallback file %s: %v", err, s.fallback.path, fallbackErr)
+	}
+	return nil
+}
+
+func (s *tableDeadLetterSink) Replay(fn func(letter *DeadLetter) error) (int, error) {
+	replayed, err := s.replayTable(fn)
+	if err != nil {
+		return replayed, err
+	}
+	fallback, err := s.fallback.Replay(fn)
+	return replayed + fallback, err
+}
+
+func (s *tableDeadLetterSink) replayTable(fn func(letter *DeadLetter) error) (int, error) {
+	var (
+		replayed int
+		lastId   int64
+	)
+	for {
+		letters, ids, err := s.load(lastId)
+		if err != nil {
+			return replayed, err
+		}
+		if len(letters) == 0 {
+			return replayed, nil
+		}
+		for i, letter := range letters {
+			lastId = ids[i]
+			if err := fn(letter); err == ErrKeepDeadLetter {
+				continue
+			} else if err != nil {
+				return replayed, err
+			}
+			if _, err := s.mysql_client.Exec(deleteDeadLetter, ids[i]); err != nil {
+				return replayed, err
+			}
+			replayed++
+		}
+	}
+}
+
+func (s *tableDeadLetterSink) load(lastId int64) ([]*DeadLetter, []int64, error) {
+	rows, err := s.mysql_client.Query(queryDeadLetters, lastId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var (
+		letters []*DeadLetter
+		ids     []int64
+	)
+	for rows.Next() {
+		var (
+			id     int64
+			batch  string
+			letter DeadLetter
+		)
+		if err := rows.Scan(&id, &letter.CreatedAt, &letter.ErrorCode, &letter.Error, &batch); err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal([]byte(batch), &letter.Spans); err != nil {
+			return nil, nil, fmt.Errorf("dead letter %d: %v", id, err)
+		}
+		letters = append(letters, &letter)
+		ids = append(ids, id)
+	}
+	return letters, ids, rows.Err()
+}
+
+// fileDeadLetterSink appends the letters to a file, one json document per line
+type fileDeadLetterSink struct {
+	path string
+	lock sync.Mutex
+}
+
+func (s *fileDeadLetterSink) Write(letter *DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// dead letters are rare, opening the file every time lets Replay move it away safely
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *fileDeadLetterSink) Replay(fn func(letter *DeadLetter) error) (int, error) {
+	replayPath := s.path + ".replay"
+	// a replay file left by an interrupted run is finished first
+	if _, err := os.Stat(replayPath); os.IsNotExist(err) {
+		s.lock.Lock()
+		err = os.Rename(s.path, replayPath)
+		s.lock.Unlock()
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	f, err := os.Open(replayPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var (
+		replayed  int
+		corrupted int
+		replayErr error
+		remaining []*DeadLetter
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		letter := new(DeadLetter)
+		if err := json.Unmarshal(scanner.Bytes(), letter); err != nil {
+			corrupted++
+			continue
+		}
+		if replayErr == nil {
+			replayErr = fn(letter)
+			if replayErr == nil {
+				replayed++
+				continue
+			}
+			if replayErr == ErrKeepDeadLetter {
+				replayErr = nil
+			}
+		}
+		remaining = append(remaining, letter)
+	}
+	if err := scanner.Err(); err != nil {
+		return replayed, err
+	}
+	// put back whatever was not replayed
+	for _, letter := range remaining {
+		if err := s.Write(letter); err != nil {
+			return replayed, err
+		}
+	}
+	if err := os.Remove(replayPath); err != nil {
+		return replayed, err
+	}
+	if replayErr == nil && corrupted > 0 {
+		replayErr = fmt.Errorf("skipped %d corrupted lines in %s", corrupted, replayPath)
+	}
+	return replayed, replayErr
+}
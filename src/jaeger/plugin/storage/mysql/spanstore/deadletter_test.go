@@ -0,0 +1,60 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTableDeadLetterFallback checks the letters the table refuses end up in the fallback file
+func TestTableDeadLetterFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &recordingDriver{failOn: "INSERT INTO traces_dead_letter"}
+	db := openRecordingDB(t, d)
+	defer db.Close()
+
+	path := filepath.Join(dir, "dead_letter.json")
+	sink, err := NewDeadLetterSink(DeadLetterTable, db, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	letter := &DeadLetter{CreatedAt: 1, ErrorCode: 2013, Error: "lost connection"}
+	if err := sink.Write(letter); err != nil {
+		t.Fatalf("write with a fallback: %v", err)
+	}
+	if len(d.statements) != 1 || d.statements[0] != insertDeadLetter {
+		t.Errorf("statements %q, want the table insert first", d.statements)
+	}
+
+	fallback := &fileDeadLetterSink{path: path}
+	var replayed []*DeadLetter
+	n, err := fallback.Replay(func(letter *DeadLetter) error {
+		replayed = append(replayed, letter)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(replayed) != 1 || replayed[0].Error != letter.Error || replayed[0].ErrorCode != letter.ErrorCode {
+		t.Errorf("fallback file replayed %d letters %+v, want the refused letter", n, replayed)
+	}
+}
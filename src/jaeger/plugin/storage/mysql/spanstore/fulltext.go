@@ -0,0 +1,77 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	// TextSearchTag is the reserved tag key searching a fragment of the tag and log values,
+	// e.g. _text=connection refused
+	TextSearchTag = "_text"
+	// maxSearchTextLength bounds the search_text of a span in bytes, the end of longer values is not searchable
+	maxSearchTextLength = 16 << 10
+)
+
+// searchText flattens the values of the span tags and of the log fields into the search_text column
+func searchText(span *model.Span) string {
+	var text strings.Builder
+	add := func(kvs []model.KeyValue) bool {
+		for _, kv := range kvs {
+			if kv.VType == model.BinaryType {
+				continue
+			}
+			value := kv.AsString()
+			if value == "" {
+				continue
+			}
+			if text.Len()+len(value)+1 > maxSearchTextLength {
+				value = value[:maxSearchTextLength-text.Len()]
+				// do not leave half a character behind
+				for len(value) > 0 && !utf8.ValidString(value) {
+					value = value[:len(value)-1]
+				}
+				text.WriteString(value)
+				return false
+			}
+			text.WriteString(value)
+			text.WriteByte('\n')
+		}
+		return true
+	}
+	if !add(span.Tags) {
+		return text.String()
+	}
+	for _, log := range span.Logs {
+		if !add(log.Fields) {
+			break
+		}
+	}
+	return text.String()
+}
+
+// booleanOperators are the boolean mode operators, they are searched as word separators
+var booleanOperators = strings.NewReplacer(`"`, " ", "+", " ", "-", " ", "<", " ", ">", " ", "(", " ", ")", " ",
+	"~", " ", "*", " ", "@", " ")
+
+// textCondition matches the spans whose tag or log values hold the words of the fragment in that order
+func textCondition(fragment string) (string, []interface{}) {
+	phrase := `"` + booleanOperators.Replace(fragment) + `"`
+	return "MATCH(search_text) AGAINST(? IN BOOLEAN MODE)", []interface{}{phrase}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SchemaText stores tags, logs and process as text, see sql/full.sql (mysql >= 5.7)
+	SchemaText = "text"
+	// SchemaJSON stores them as JSON with a multi-valued index on the tag keys, see sql/full_mysql8.sql (mysql >= 8.0.17)
+	SchemaJSON = "json"
+)
+
+// ValidateSchema checks schema is one of the supported traces schemas
+func ValidateSchema(schema string) error {
+	switch schema {
+	case SchemaText, SchemaJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown schema %q, expect %s or %s", schema, SchemaText, SchemaJSON)
+}
+
+// jsonTagCandidates returns the stored forms a tag searched as key=value may have. The value type is not
+// known from the query, so every type the value parses as is tried. The JSON encoding of the tags omits
+// false and zero values, such tags are only matched as strings.
+func jsonTagCandidates(key string, value string) []string {
+	var candidates []map[string]interface{}
+	if value != "" {
+		candidates = append(candidates, map[string]interface{}{"key": key, "v_str": value})
+	}
+	if value == "true" {
+		candidates = append(candidates, map[string]interface{}{"key": key, "v_bool": true})
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil && n != 0 {
+		candidates = append(candidates, map[string]interface{}{"key": key, "v_int64": n})
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && f != 0 {
+		candidates = append(candidates, map[string]interface{}{"key": key, "v_float64": f})
+	}
+	var encoded []string
+	for _, candidate := range candidates {
+		data, _ := json.Marshal(candidate)
+		encoded = append(encoded, string(data))
+	}
+	return encoded
+}
+
+// jsonTagCondition matches the spans with a span or process tag, MEMBER OF uses the idx_tag_keys
+// multi-valued index and JSON_CONTAINS checks the value on the rows it finds
+func jsonTagCondition(key string, value string) (string, []interface{}) {
+	args := []interface{}{key}
+	var matches []string
+	for _, candidate := range jsonTagCandidates(key, value) {
+		matches = append(matches, "JSON_CONTAINS(tags, ?)", "JSON_CONTAINS(process, ?, '$.tags')")
+		args = append(args, candidate, candidate)
+	}
+	if len(matches) == 0 {
+		return "? MEMBER OF(tag_keys)", args
+	}
+	return "? MEMBER OF(tag_keys) AND (" + strings.Join(matches, " OR ") + ")", args
+}
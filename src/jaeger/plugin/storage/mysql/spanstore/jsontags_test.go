@@ -0,0 +1,51 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONTagConditionQuotes(t *testing.T) {
+	key, value := `it's "quoted"`, `x'), '$') OR 1=1 -- \ "`
+	condition, args := jsonTagCondition(key, value)
+
+	if strings.Contains(condition, "quoted") || strings.Contains(condition, "1=1") {
+		t.Errorf("the tag ends up in the condition: %s", condition)
+	}
+	if placeholders := strings.Count(condition, "?"); placeholders != len(args) {
+		t.Fatalf("%d placeholders for %d args", placeholders, len(args))
+	}
+	if args[0] != key {
+		t.Errorf("got key %#v, want %q", args[0], key)
+	}
+	if len(args) != 3 {
+		t.Fatalf("got %d args, want the key and the string candidate twice", len(args))
+	}
+	for _, arg := range args[1:] {
+		var tag struct {
+			Key  string `json:"key"`
+			VStr string `json:"v_str"`
+		}
+		if err := json.Unmarshal([]byte(arg.(string)), &tag); err != nil {
+			t.Fatalf("candidate %q is not valid JSON: %v", arg, err)
+		}
+		if tag.Key != key || tag.VStr != value {
+			t.Errorf("candidate %q decodes to %q=%q", arg, tag.Key, tag.VStr)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/smartwalle/dbs"
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+const (
+	// InsertMethodInsert stores the batches with multi-row INSERT statements
+	InsertMethodInsert = "insert"
+	// InsertMethodLoadData streams the batches with LOAD DATA LOCAL INFILE, it needs local_infile=ON on the server
+	InsertMethodLoadData = "load-data"
+)
+
+// ValidateInsertMethod returns an error for an unknown insert method
+func ValidateInsertMethod(method string) error {
+	switch method {
+	case InsertMethodInsert, InsertMethodLoadData:
+		return nil
+	}
+	return fmt.Errorf("unknown insert method %q, expect %s or %s", method, InsertMethodInsert, InsertMethodLoadData)
+}
+
+var traceColumns = []string{"trace_id", "span_id", "span_hash", "parent_id", "operation_name", "flags",
+	"start_time", "duration", "tags", "logs", "refs", "process", "service_name", "http_code", "error", "span_kind"}
+
+// columns returns the traces columns written for every span, the promoted tag columns then search_text last
+func (b *BackgroudStore) columns() []string {
+	if b.promoted == nil && !b.fullText {
+		return traceColumns
+	}
+	columns := append([]string{}, traceColumns...)
+	if b.promoted != nil {
+		columns = append(columns, b.promoted.Columns()...)
+	}
+	if b.fullText {
+		columns = append(columns, "search_text")
+	}
+	return columns
+}
+
+// loadDataSeq names the reader handler of every LOAD DATA statement, handlers are global to the driver
+var loadDataSeq int64
+
+// loadDataEscaper escapes the field and line terminators as well as the escape character itself,
+// the JSON columns are full of backslashes and may hold raw tabs or newlines from the span logs
+var loadDataEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"\t", "\\t",
+	"\n", "\\n",
+	"\r", "\\r",
+	"\x00", "\\0",
+)
+
+// encodeLoadData writes the spans in the default LOAD DATA format: tab separated fields, one line per span,
+// the promoted tags then the search text last
+func encodeLoadData(w io.Writer, spans []*dbmodel.Span, promoted *PromotedTags, fullText bool) error {
+	buf := make([]byte, 0, 4096)
+	for _, span := range spans {
+		buf = buf[:0]
+		buf = append(buf, loadDataEscaper.Replace(span.TraceID)...)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, span.SpanID, 10)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, span.SpanHash, 10)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, span.ParentID, 10)
+		buf = append(buf, '\t')
+		buf = append(buf, loadDataEscaper.Replace(span.OperationName)...)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, int64(span.Flags), 10)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, span.StartTime, 10)
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, span.Duration, 10)
+		for _, field := range []string{span.Tags, span.Logs, span.Refs, span.Process, span.ServiceName} {
+			buf = append(buf, '\t')
+			buf = append(buf, loadDataEscaper.Replace(field)...)
+		}
+		buf = append(buf, '\t')
+		buf = strconv.AppendInt(buf, span.HttpCode, 10)
+		buf = append(buf, '\t')
+		if span.Error {
+			buf = append(buf, '1')
+		} else {
+			buf = append(buf, '0')
+		}
+		buf = append(buf, '\t')
+		buf = append(buf, loadDataEscaper.Replace(span.SpanKind)...)
+		if promoted != nil {
+			for _, key := range promoted.Keys() {
+				buf = append(buf, '\t')
+				buf = append(buf, loadDataEscaper.Replace(span.PromotedTags[key])...)
+			}
+		}
+		if fullText {
+			buf = append(buf, '\t')
+			buf = append(buf, loadDataEscaper.Replace(span.SearchText)...)
+		}
+		buf = append(buf, '\n')
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batch_load stores the spans with LOAD DATA LOCAL INFILE. The server turns most data errors into warnings
+// for LOCAL loads and skips the duplicated rows, so poisoned spans are stored truncated instead of rejected.
+func (b *BackgroudStore) batch_load(db dbs.Executor, spans []*dbmodel.Span) error {
+	var data bytes.Buffer
+	if err := encodeLoadData(&data, spans, b.promoted, b.fullText); err != nil {
+		return err
+	}
+	name := "spans" + strconv.FormatInt(atomic.AddInt64(&loadDataSeq, 1), 10)
+	mysql.RegisterReaderHandler(name, func() io.Reader {
+		return &data
+	})
+	defer mysql.DeregisterReaderHandler(name)
+
+	ignore := ""
+	if b.idempotent {
+		ignore = "IGNORE "
+	}
+	query := fmt.Sprintf("LOAD DATA LOCAL INFILE 'Reader::%s' %sINTO TABLE traces CHARACTER SET utf8 (%s)",
+		name, ignore, strings.Join(b.columns(), ", "))
+	start := time.Now()
+	_, err := db.Exec(query)
+	b.recordInsert(time.Since(start), err)
+	if err != nil {
+		b.logger.Error("batch load error", zap.Error(err), zap.Int("spans", len(spans)))
+	}
+	return err
+}
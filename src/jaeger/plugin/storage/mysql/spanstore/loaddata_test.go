@@ -0,0 +1,206 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"bytes"
+	"database/sql"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/uber/jaeger-lib/metrics"
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+// the insert benchmarks need a mysql initialized with sql/full.sql and local_infile=ON, e.g.
+// MYSQL_URL="root:111111@tcp(127.0.0.1:3306)/go?charset=utf8" go test -run none -bench . ./plugin/storage/mysql/spanstore
+const benchBatchSize = 50
+
+func benchSpans(n int) []*dbmodel.Span {
+	spans := make([]*dbmodel.Span, n)
+	traceID := strconv.FormatInt(rand.Int63(), 16)
+	for i := range spans {
+		spans[i] = &dbmodel.Span{
+			TraceID:       traceID,
+			SpanID:        rand.Int63(),
+			SpanHash:      rand.Int63(),
+			OperationName: "HTTP GET /api/traces",
+			StartTime:     time.Now().UnixNano() / 1000,
+			Duration:      1500,
+			Tags:          `[{"key":"http.url","type":"string","value":"/api/traces?service=a\tb"}]`,
+			Logs:          `[{"timestamp":1,"fields":[{"key":"event","type":"string","value":"line1\nline2 \"quoted\" C:\\tmp"}]}]`,
+			Refs:          `[]`,
+			Process:       `{"service_name":"bench","tags":[]}`,
+			ServiceName:   "bench",
+			HttpCode:      200,
+		}
+	}
+	return spans
+}
+
+func benchmarkBatchInsert(b *testing.B, method string) {
+	url := os.Getenv("MYSQL_URL")
+	if url == "" {
+		b.Skip("MYSQL_URL is not set")
+	}
+	db, err := sql.Open("mysql", url)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	backgroudMetrics := NewBackgroudMetrics(metrics.NullCounter, metrics.NullCounter, metrics.NullCounter,
+		metrics.NullCounter, nil, nil, metrics.NullCounter, metrics.NullGauge, metrics.NullGauge, metrics.NullGauge)
+	store := NewBackgroudStore(db, nil, nil, nil, NewRetryPolicy(1, 0, 0), nil, zap.NewNop(),
+		BackgroudOptions{Batchsize: benchBatchSize, Idempotent: true, InsertMethod: method}, backgroudMetrics)
+
+	batches := make([][]*dbmodel.Span, b.N)
+	for i := range batches {
+		batches[i] = benchSpans(benchBatchSize)
+	}
+	b.ResetTimer()
+	start := time.Now()
+	for _, batch := range batches {
+		if err := store.batch_insert(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*benchBatchSize)/time.Since(start).Seconds(), "spans/s")
+}
+
+func BenchmarkBatchInsert(b *testing.B) {
+	benchmarkBatchInsert(b, InsertMethodInsert)
+}
+
+func BenchmarkBatchLoadData(b *testing.B) {
+	benchmarkBatchInsert(b, InsertMethodLoadData)
+}
+
+func BenchmarkEncodeLoadData(b *testing.B) {
+	spans := benchSpans(benchBatchSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := encodeLoadData(ioutil.Discard, spans, nil, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// decodeLoadData reads the rows back as the server does with the default FIELDS TERMINATED BY '\t'
+// ESCAPED BY '\\' LINES TERMINATED BY '\n'
+func decodeLoadData(t *testing.T, data string) [][]string {
+	unescaped := map[byte]byte{'\\': '\\', 't': '\t', 'n': '\n', 'r': '\r', '0': 0}
+	var (
+		rows  [][]string
+		row   []string
+		field strings.Builder
+	)
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '\\':
+			i++
+			if i == len(data) {
+				t.Fatalf("escape character at the end of %q", data)
+			}
+			u, ok := unescaped[data[i]]
+			if !ok {
+				t.Fatalf("unexpected escape sequence \\%c in %q", data[i], data)
+			}
+			field.WriteByte(u)
+		case '\t':
+			row = append(row, field.String())
+			field.Reset()
+		case '\n':
+			rows = append(rows, append(row, field.String()))
+			row = nil
+			field.Reset()
+		default:
+			field.WriteByte(c)
+		}
+	}
+	if len(row) > 0 || field.Len() > 0 {
+		t.Fatalf("last row of %q is not terminated", data)
+	}
+	return rows
+}
+
+func TestEncodeLoadDataRoundTrip(t *testing.T) {
+	values := []string{
+		"",
+		"plain",
+		"tab\tseparated",
+		"line1\nline2\r\n",
+		`C:\tmp\new`,
+		`trailing backslash\`,
+		`\t is not a tab`,
+		"nul\x00byte",
+		`{"key":"event","v_str":"say \"hi\"\n\tindented"}`,
+		"\t\n\\\x00",
+	}
+	promoted, err := NewPromotedTags([]string{"http.url"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spans []*dbmodel.Span
+	for i, value := range values {
+		spans = append(spans, &dbmodel.Span{
+			TraceID:       "abc",
+			SpanID:        int64(i),
+			SpanHash:      -int64(i),
+			ParentID:      1,
+			OperationName: value,
+			Flags:         1,
+			StartTime:     1500000000000000,
+			Duration:      1500,
+			Tags:          value,
+			Logs:          value,
+			Refs:          value,
+			Process:       value,
+			ServiceName:   value,
+			HttpCode:      503,
+			Error:         i%2 == 0,
+			SpanKind:      value,
+			PromotedTags:  map[string]string{"http.url": value},
+			SearchText:    value,
+		})
+	}
+	var data bytes.Buffer
+	if err := encodeLoadData(&data, spans, promoted, true); err != nil {
+		t.Fatal(err)
+	}
+	rows := decodeLoadData(t, data.String())
+	if len(rows) != len(spans) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(spans))
+	}
+	for i, value := range values {
+		isError := "0"
+		if i%2 == 0 {
+			isError = "1"
+		}
+		want := []string{"abc", strconv.Itoa(i), strconv.Itoa(-i), "1", value, "1", "1500000000000000", "1500",
+			value, value, value, value, value, "503", isError, value, value, value}
+		if !reflect.DeepEqual(rows[i], want) {
+			t.Errorf("row %d\n got: %q\nwant: %q", i, rows[i], want)
+		}
+	}
+}
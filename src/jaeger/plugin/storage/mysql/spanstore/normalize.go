@@ -0,0 +1,79 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// OriginalOperationTag keeps the operation name of a span renamed by the normalization rules
+const OriginalOperationTag = "operation.original"
+
+// OperationRule rewrites the operation names of a service matching Pattern into Replacement,
+// which may refer to the groups of the pattern, e.g. $1 or ${name}
+type OperationRule struct {
+	// Service is optional, empty applies the rule to every service
+	Service     string
+	Pattern     string
+	Replacement string
+}
+
+type operationRule struct {
+	service     string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Normalizer rewrites the operation names with the rules, e.g. /users/8812 into /users/{id},
+// so that the operations of a service stay few and can be searched by their normalized name
+type Normalizer struct {
+	rules []operationRule
+}
+
+// NewNormalizer compiles the rules, they are applied in order and all the matching ones are applied
+func NewNormalizer(rules []OperationRule) (*Normalizer, error) {
+	n := &Normalizer{}
+	for i, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("operation rule %d: invalid pattern %q: %v", i, rule.Pattern, err)
+		}
+		n.rules = append(n.rules, operationRule{service: rule.Service, pattern: pattern, replacement: rule.Replacement})
+	}
+	return n, nil
+}
+
+// Normalize returns the span with its operation name normalized and the original name in the
+// OriginalOperationTag tag, or the span itself when no rule changes its name. The given span is not modified.
+func (n *Normalizer) Normalize(span *model.Span) *model.Span {
+	operation := span.OperationName
+	for _, rule := range n.rules {
+		if rule.service == "" || rule.service == span.Process.ServiceName {
+			operation = rule.pattern.ReplaceAllString(operation, rule.replacement)
+		}
+	}
+	if operation == span.OperationName {
+		return span
+	}
+	normalized := *span
+	normalized.OperationName = operation
+	normalized.Tags = make([]model.KeyValue, 0, len(span.Tags)+1)
+	normalized.Tags = append(normalized.Tags, span.Tags...)
+	normalized.Tags = append(normalized.Tags, model.String(OriginalOperationTag, span.OperationName))
+	return &normalized
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+const (
+	// defaultMaxAllowedPacket is the mysql 5.7 default, used until the server tells otherwise
+	defaultMaxAllowedPacket = 4 << 20
+	maxPacketInterval       = time.Minute
+	// statementOverhead covers the insert statement itself, rowOverhead the numeric columns,
+	// the quotes and the separators of one row
+	statementOverhead = 1024
+	rowOverhead       = 256
+	// maxPlaceholders is the most placeholders of a prepared statement, beyond it mysql fails with 1390
+	maxPlaceholders = 65535
+)
+
+// ErrSpanTooLarge is returned for a span that does not fit in a max_allowed_packet on its own
+var ErrSpanTooLarge = errors.New("span exceeds max_allowed_packet")
+
+// refreshMaxPacket reads max_allowed_packet from the server, the last known value is kept on error
+func (b *BackgroudStore) refreshMaxPacket() {
+	var maxPacket int64
+	if err := b.mysql_client.QueryRow("SELECT @@max_allowed_packet").Scan(&maxPacket); err != nil {
+		b.logger.Warn("read max_allowed_packet error", zap.Error(err), zap.Int64("maxAllowedPacket", b.maxPacket()))
+		return
+	}
+	if old := atomic.SwapInt64(&b.maxAllowedPacket, maxPacket); old != maxPacket {
+		b.logger.Info("max_allowed_packet changed", zap.Int64("old", old), zap.Int64("new", maxPacket))
+	}
+}
+
+// watchMaxPacket follows the changes of max_allowed_packet, e.g. a SET GLOBAL by the dba
+func (b *BackgroudStore) watchMaxPacket() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(maxPacketInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+			b.refreshMaxPacket()
+		}
+	}
+}
+
+func (b *BackgroudStore) maxPacket() int64 {
+	if maxPacket := atomic.LoadInt64(&b.maxAllowedPacket); maxPacket > 0 {
+		return maxPacket
+	}
+	return defaultMaxAllowedPacket
+}
+
+// packetBudget returns the bytes the rows of one insert may take, with a margin for escaping
+func (b *BackgroudStore) packetBudget() int64 {
+	return b.maxPacket()*9/10 - statementOverhead
+}
+
+// spanSize estimates the bytes a span takes in an insert statement, its span_tags rows are
+// written by another statement of the same chunk and counted as well
+func spanSize(span *dbmodel.Span) int64 {
+	return int64(len(span.TraceID)+len(span.OperationName)+len(span.Tags)+len(span.Logs)+
+		len(span.Refs)+len(span.Process)+len(span.ServiceName)+len(span.SpanKind)+len(span.SearchText)) + rowOverhead + indexTagsSize(span) +
+		promotedTagsSize(span)
+}
+
+func promotedTagsSize(span *dbmodel.Span) int64 {
+	var size int64
+	for _, value := range span.PromotedTags {
+		size += int64(len(value)) + 4
+	}
+	return size
+}
+
+// splitBatch splits the batch in chunks that each fit in one insert statement, in max_allowed_packet
+// and in the placeholders of a prepared statement. The spans that can not fit in any statement are returned apart.
+func (b *BackgroudStore) splitBatch(batch []*dbmodel.Span) ([][]*dbmodel.Span, []*dbmodel.Span) {
+	budget := b.packetBudget()
+	maxRows := len(batch)
+	if !b.loadData {
+		maxRows = maxPlaceholders / len(b.columns())
+	}
+	var (
+		chunks   [][]*dbmodel.Span
+		oversize []*dbmodel.Span
+		chunk    []*dbmodel.Span
+		size     int64
+	)
+	for _, span := range batch {
+		spanBytes := spanSize(span)
+		if spanBytes > budget {
+			oversize = append(oversize, span)
+			continue
+		}
+		if (size+spanBytes > budget || len(chunk) >= maxRows) && len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, span)
+		size += spanBytes
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks, oversize
+}
+
+func (b *BackgroudStore) spanTooLargeError(span *dbmodel.Span) error {
+	return fmt.Errorf("%w: about %d bytes, max_allowed_packet is %d", ErrSpanTooLarge, spanSize(span), b.maxPacket())
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+// lanes of the priority queue, a lower index is served first
+const (
+	LanePriority = iota
+	LaneNormal
+	laneCount
+)
+
+// LaneNames are used to tag the lane metrics, indexed by lane
+var LaneNames = [laneCount]string{"priority", "normal"}
+
+const (
+	// OverflowDropNewest drops the span arriving to a full lane
+	OverflowDropNewest = "drop-newest"
+	// OverflowDropOldest drops the oldest span of the full lane to make room for the new one
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropLowestPriority drops the oldest span of the lowest priority lane holding any,
+	// or the new span when it belongs to that lane. The lanes share the sum of their capacities
+	// instead of being bounded one by one.
+	OverflowDropLowestPriority = "drop-lowest-priority"
+)
+
+// ValidateOverflowPolicy checks policy is one of the supported overflow policies
+func ValidateOverflowPolicy(policy string) error {
+	switch policy {
+	case OverflowDropNewest, OverflowDropOldest, OverflowDropLowestPriority:
+		return nil
+	}
+	return fmt.Errorf("unknown overflow policy %q", policy)
+}
+
+// spanLane returns the lane of a span: errors, 5xx and debug spans are never dropped before the normal ones
+func spanLane(span *dbmodel.Span) int {
+	if span.Error || span.HttpCode >= 500 || model.Flags(uint32(span.Flags)).IsDebug() {
+		return LanePriority
+	}
+	return LaneNormal
+}
+
+// spanRing is a growable fifo of spans
+type spanRing struct {
+	buf  []*dbmodel.Span
+	head int
+	size int
+}
+
+func (r *spanRing) push(span *dbmodel.Span) {
+	if r.size == len(r.buf) {
+		buf := make([]*dbmodel.Span, 2*len(r.buf)+64)
+		for i := 0; i < r.size; i++ {
+			buf[i] = r.buf[(r.head+i)%len(r.buf)]
+		}
+		r.buf, r.head = buf, 0
+	}
+	r.buf[(r.head+r.size)%len(r.buf)] = span
+	r.size++
+}
+
+func (r *spanRing) pop() *dbmodel.Span {
+	span := r.buf[r.head]
+	r.buf[r.head] = nil
+	r.head = (r.head + 1) % len(r.buf)
+	r.size--
+	return span
+}
+
+// PriorityQueue sits in front of the eventQueue and feeds it lane by lane, so that under pressure
+// the spans of the normal lane are dropped while the priority lane still makes progress.
+type PriorityQueue struct {
+	out      chan *dbmodel.Span
+	capacity [laneCount]int
+	policy   string
+
+	lock  sync.Mutex
+	lanes [laneCount]spanRing
+	// sending is the span taken off a lane and not accepted by the eventQueue yet
+	sending int
+	closed  bool
+	// notEmpty wakes up the forwarder, space the writers waiting for room
+	notEmpty chan struct{}
+	space    chan struct{}
+	waiters  int
+}
+
+// NewPriorityQueue creates the queue and starts forwarding to out, which is closed once the queue is closed and drained
+func NewPriorityQueue(out chan *dbmodel.Span, priorityLength int, normalLength int, policy string) *PriorityQueue {
+	q := &PriorityQueue{
+		out:      out,
+		capacity: [laneCount]int{priorityLength, normalLength},
+		policy:   policy,
+		notEmpty: make(chan struct{}, 1),
+		space:    make(chan struct{}),
+	}
+	go q.forward()
+	return q
+}
+
+// Put adds the span to its lane, waiting at most timeout for room. When the lane stays full,
+// the overflow policy picks the span to drop and returns it: the new span or an evicted one.
+func (q *PriorityQueue) Put(span *dbmodel.Span, timeout time.Duration) *dbmodel.Span {
+	lane := spanLane(span)
+	var deadline <-chan time.Time
+	q.lock.Lock()
+	for !q.closed && q.full(lane) && timeout > 0 {
+		if deadline == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		space := q.space
+		q.waiters++
+		q.lock.Unlock()
+		select {
+		case <-space:
+		case <-deadline:
+			timeout = 0
+		}
+		q.lock.Lock()
+		q.waiters--
+	}
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return span
+	}
+	var dropped *dbmodel.Span
+	if q.full(lane) {
+		switch q.policy {
+		case OverflowDropOldest:
+			if q.lanes[lane].size == 0 {
+				return span
+			}
+			dropped = q.lanes[lane].pop()
+		case OverflowDropLowestPriority:
+			for victim := laneCount - 1; victim > lane; victim-- {
+				if q.lanes[victim].size > 0 {
+					dropped = q.lanes[victim].pop()
+					break
+				}
+			}
+			if dropped == nil {
+				return span
+			}
+		default:
+			return span
+		}
+	}
+	q.lanes[lane].push(span)
+	select {
+	case q.notEmpty <- struct{}{}:
+	default:
+	}
+	return dropped
+}
+
+// full reports whether the lane has no room left, with OverflowDropLowestPriority only the total is bounded
+func (q *PriorityQueue) full(lane int) bool {
+	if q.policy != OverflowDropLowestPriority {
+		return q.lanes[lane].size >= q.capacity[lane]
+	}
+	n := 0
+	for i := range q.lanes {
+		n += q.lanes[i].size
+	}
+	return n >= q.Cap()
+}
+
+// Len returns the number of spans waiting in the lanes
+func (q *PriorityQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	n := q.sending
+	for i := range q.lanes {
+		n += q.lanes[i].size
+	}
+	return n
+}
+
+// Cap returns the total capacity of the lanes
+func (q *PriorityQueue) Cap() int {
+	n := 0
+	for _, capacity := range q.capacity {
+		n += capacity
+	}
+	return n
+}
+
+// Close stops accepting spans, what is left in the lanes is still forwarded
+func (q *PriorityQueue) Close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	select {
+	case q.notEmpty <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the oldest span of the highest priority lane, waiting for one, false once closed and drained
+func (q *PriorityQueue) take() (*dbmodel.Span, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		for i := range q.lanes {
+			if q.lanes[i].size > 0 {
+				span := q.lanes[i].pop()
+				q.sending = 1
+				if q.waiters > 0 {
+					close(q.space)
+					q.space = make(chan struct{})
+				}
+				return span, true
+			}
+		}
+		if q.closed {
+			return nil, false
+		}
+		q.lock.Unlock()
+		<-q.notEmpty
+		q.lock.Lock()
+	}
+}
+
+func (q *PriorityQueue) forward() {
+	for {
+		span, ok := q.take()
+		if !ok {
+			close(q.out)
+			return
+		}
+		q.out <- span
+		q.lock.Lock()
+		q.sending = 0
+		q.lock.Unlock()
+	}
+}
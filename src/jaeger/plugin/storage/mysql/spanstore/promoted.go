@@ -0,0 +1,160 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	promotedColumnPrefix = "tag_"
+	// maxColumnLength is the mysql limit on identifiers, the index name adds idx_ to the column
+	maxColumnLength   = 60
+	queryTraceColumns = "SELECT column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'traces'"
+)
+
+// commentEscaper escapes a key for a quoted string literal. The backslash is an escape character in the
+// default sql_mode, a key ending with one would swallow the closing quote. Under NO_BACKSLASH_ESCAPES the
+// comment keeps the doubled backslashes, the literal is still closed where expected.
+var commentEscaper = strings.NewReplacer(`\`, `\\`, "'", "''")
+
+// PromotedTags are the tags written to a traces column of their own, tag_<key> with the characters
+// other than letters and digits turned into _, e.g. http.method into tag_http_method
+type PromotedTags struct {
+	keys    []string
+	columns map[string]string
+}
+
+// NewPromotedTags names the columns of the keys, two keys may not share a column
+func NewPromotedTags(keys []string) (*PromotedTags, error) {
+	p := &PromotedTags{columns: map[string]string{}}
+	owners := map[string]string{}
+	for _, key := range keys {
+		if _, ok := p.columns[key]; ok {
+			continue
+		}
+		if _, ok := columnTags[key]; ok {
+			return nil, fmt.Errorf("tag %q already has a traces column", key)
+		}
+		column := promotedColumn(key)
+		if len(column) > maxColumnLength {
+			return nil, fmt.Errorf("promoted tag %q is too long for a column name", key)
+		}
+		if owner, ok := owners[column]; ok {
+			return nil, fmt.Errorf("promoted tags %q and %q both map to column %s", owner, key, column)
+		}
+		owners[column] = key
+		p.keys = append(p.keys, key)
+		p.columns[key] = column
+	}
+	return p, nil
+}
+
+func promotedColumn(key string) string {
+	column := []byte(promotedColumnPrefix)
+	for _, c := range []byte(strings.ToLower(key)) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			column = append(column, c)
+		} else {
+			column = append(column, '_')
+		}
+	}
+	return string(column)
+}
+
+// Keys returns the promoted tag keys, in the order of their columns
+func (p *PromotedTags) Keys() []string {
+	return p.keys
+}
+
+// Columns returns the traces columns of the promoted tags
+func (p *PromotedTags) Columns() []string {
+	columns := make([]string, 0, len(p.keys))
+	for _, key := range p.keys {
+		columns = append(columns, p.columns[key])
+	}
+	return columns
+}
+
+// Column returns the traces column of a promoted tag
+func (p *PromotedTags) Column(key string) (string, bool) {
+	column, ok := p.columns[key]
+	return column, ok
+}
+
+// Values returns the promoted tags of the span, the span tags win over the process tags
+func (p *PromotedTags) Values(span *model.Span) map[string]string {
+	values := map[string]string{}
+	if span.Process != nil {
+		p.collect(values, span.Process.Tags)
+	}
+	p.collect(values, span.Tags)
+	return values
+}
+
+func (p *PromotedTags) collect(values map[string]string, tags []model.KeyValue) {
+	for _, tag := range tags {
+		if _, ok := p.columns[tag.Key]; ok {
+			values[tag.Key] = truncateTagValue(tag.AsString())
+		}
+	}
+}
+
+// MissingColumns returns the keys whose column is not in the traces table yet
+func (p *PromotedTags) MissingColumns(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(queryTraceColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	existing := map[string]struct{}{}
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		existing[strings.ToLower(column)] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, key := range p.keys {
+		if _, ok := existing[p.columns[key]]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// MigrationSQL returns the statement adding the columns of the keys and their indexes to the traces table
+func (p *PromotedTags) MigrationSQL(keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	var clauses []string
+	for _, key := range keys {
+		column := promotedColumn(key)
+		clauses = append(clauses,
+			fmt.Sprintf("  ADD COLUMN `%s` varchar(%d) NOT NULL DEFAULT '' COMMENT '%s'", column, maxTagValueLength,
+				commentEscaper.Replace(key)),
+			fmt.Sprintf("  ADD KEY `idx_%s` (`%s`,`start_time`)", column, column))
+	}
+	return "ALTER TABLE `traces`\n" + strings.Join(clauses, ",\n") + ";\n"
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrationSQLEscapesComment(t *testing.T) {
+	for key, comment := range map[string]string{
+		"http.method":   `'http.method'`,
+		"O'Reilly":      `'O''Reilly'`,
+		`path\`:         `'path\\'`,
+		`x\', 1); DROP`: `'x\\'', 1); DROP'`,
+	} {
+		promoted := mustPromoted(t, key)
+		sql := promoted.MigrationSQL(promoted.Keys())
+		if !strings.Contains(sql, " COMMENT "+comment+",\n") {
+			t.Errorf("%q: comment %s not found in\n%s", key, comment, sql)
+		}
+	}
+}
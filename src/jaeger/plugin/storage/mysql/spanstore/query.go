@@ -0,0 +1,182 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// defaultNumTraces is the number of traces searched when the query does not say
+const defaultNumTraces = 20
+
+// queryBuilder collects the conditions of a where clause and their arguments,
+// the values coming from the query never end up in the sql itself
+type queryBuilder struct {
+	conditions []string
+	args       []interface{}
+}
+
+func (q *queryBuilder) where(condition string, args ...interface{}) {
+	q.conditions = append(q.conditions, condition)
+	q.args = append(q.args, args...)
+}
+
+// whereIn matches the column against any of the values
+func (q *queryBuilder) whereIn(column string, values []string) {
+	if len(values) == 1 {
+		q.where(column+" = ?", values[0])
+		return
+	}
+	args := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		args = append(args, value)
+	}
+	q.where(column+" IN ("+placeholders(len(values))+")", args...)
+}
+
+// whereClause returns the conditions joined with AND, with the leading WHERE
+func (q *queryBuilder) whereClause() string {
+	if len(q.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.conditions, " AND ")
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// tagSearch tells where the tags without a traces column of their own are searched
+type tagSearch struct {
+	// promoted tags are searched on their tag_ column
+	promoted *PromotedTags
+	// jsonTags searches the JSON columns of the SchemaJSON traces table
+	jsonTags bool
+	// tagIndex searches span_tags when not nil and not jsonTags
+	tagIndex *TagIndex
+	// fullText searches the TextSearchTag in the search_text column
+	fullText bool
+}
+
+// buildTraceIDsQuery returns the query of the ids of the most recent traces matching the query and its arguments.
+// The service matches any of serviceNames. All the tags must match on the same span, as in jaeger: http.status_code
+// and error on their column, the other ones as told by search. Without a place to search them they are ignored.
+func buildTraceIDsQuery(query *spanstore.TraceQueryParameters, serviceNames []string, search tagSearch) (string, []interface{}, error) {
+	var q queryBuilder
+	if len(serviceNames) > 0 {
+		q.whereIn("service_name", serviceNames)
+	}
+	if query.OperationName != "" {
+		q.where("operation_name = ?", query.OperationName)
+	}
+	// the time range also bounds the span_tags subqueries
+	var timeRange queryBuilder
+	if !query.StartTimeMax.IsZero() {
+		timeRange.where("start_time <= ?", int64(model.TimeAsEpochMicroseconds(query.StartTimeMax)))
+	}
+	if !query.StartTimeMin.IsZero() {
+		timeRange.where("start_time >= ?", int64(model.TimeAsEpochMicroseconds(query.StartTimeMin)))
+	}
+	for i, condition := range timeRange.conditions {
+		q.where(condition, timeRange.args[i])
+	}
+	if query.DurationMax > 0 {
+		q.where("duration <= ?", int64(model.DurationAsMicroseconds(query.DurationMax)))
+	}
+	if query.DurationMin > 0 {
+		q.where("duration >= ?", int64(model.DurationAsMicroseconds(query.DurationMin)))
+	}
+
+	index := " force index(idx_time_svc_operation)"
+	if value, ok := query.Tags["http.status_code"]; ok {
+		httpCode, err := strconv.Atoi(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid http.status_code %q", value)
+		}
+		q.where("http_code = ?", httpCode)
+	}
+	if value, ok := query.Tags["error"]; ok {
+		isError, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid error tag %q", value)
+		}
+		q.where("error = ?", isError)
+	}
+	if fragment, ok := query.Tags[TextSearchTag]; ok {
+		if !search.fullText {
+			return "", nil, fmt.Errorf("full-text search of %s is not enabled", TextSearchTag)
+		}
+		condition, args := textCondition(fragment)
+		q.where(condition, args...)
+		// the fulltext index can not be used along with another forced index
+		index = ""
+	}
+
+	keys := make([]string, 0, len(query.Tags))
+	for key := range query.Tags {
+		if _, ok := columnTags[key]; !ok && key != TextSearchTag {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := query.Tags[key]
+		if search.promoted != nil {
+			if column, ok := search.promoted.Column(key); ok {
+				// the column name comes from the configuration, never from the query
+				q.where(column+" = ?", truncateTagValue(value))
+				continue
+			}
+		}
+		if search.jsonTags {
+			condition, args := jsonTagCondition(key, value)
+			q.where(condition, args...)
+			// let mysql pick the multi-valued index
+			index = ""
+			continue
+		}
+		if search.tagIndex == nil {
+			continue
+		}
+		if !search.tagIndex.Indexed(key) {
+			return "", nil, fmt.Errorf("tag %q is not indexed", key)
+		}
+		condition, args := tagCondition(key, value, timeRange)
+		q.where(condition, args...)
+	}
+
+	limit := query.NumTraces
+	if limit <= 0 {
+		limit = defaultNumTraces
+	}
+	sql := "SELECT trace_id FROM (SELECT trace_id, min(start_time) as start_time FROM traces" + index + q.whereClause() +
+		" group by trace_id) as tmp order by start_time desc limit ?"
+	return sql, append(q.args, limit), nil
+}
+
+// buildTracesQuery returns the query of the spans of the traces and its arguments
+func buildTracesQuery(traceIDs []model.TraceID) (string, []interface{}) {
+	args := make([]interface{}, 0, len(traceIDs))
+	for _, traceID := range traceIDs {
+		args = append(args, traceID.String())
+	}
+	return queryTraceByTraceIds + "(" + placeholders(len(traceIDs)) + ")", args
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+const (
+	selectTraceIDs = "SELECT trace_id FROM (SELECT trace_id, min(start_time) as start_time FROM traces"
+	forceIndex     = " force index(idx_time_svc_operation)"
+	groupAndLimit  = " group by trace_id) as tmp order by start_time desc limit ?"
+)
+
+var (
+	startTimeMin = time.Unix(1500000000, 0)
+	startTimeMax = time.Unix(1500003600, 0)
+)
+
+func mustPromoted(t *testing.T, keys ...string) *PromotedTags {
+	promoted, err := NewPromotedTags(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return promoted
+}
+
+func TestBuildTraceIDsQuery(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        spanstore.TraceQueryParameters
+		serviceNames []string
+		search       tagSearch
+		sql          string
+		args         []interface{}
+	}{
+		{
+			name: "empty",
+			sql:  selectTraceIDs + forceIndex + groupAndLimit,
+			args: []interface{}{20},
+		},
+		{
+			name:         "service",
+			query:        spanstore.TraceQueryParameters{ServiceName: "cart"},
+			serviceNames: []string{"cart"},
+			sql:          selectTraceIDs + forceIndex + " WHERE service_name = ?" + groupAndLimit,
+			args:         []interface{}{"cart", 20},
+		},
+		{
+			name:         "service aliases",
+			query:        spanstore.TraceQueryParameters{ServiceName: "cart"},
+			serviceNames: []string{"cart", "basket", "old-cart"},
+			sql:          selectTraceIDs + forceIndex + " WHERE service_name IN (?, ?, ?)" + groupAndLimit,
+			args:         []interface{}{"cart", "basket", "old-cart", 20},
+		},
+		{
+			name: "everything",
+			query: spanstore.TraceQueryParameters{
+				ServiceName:   "cart",
+				OperationName: "GET /cart",
+				StartTimeMin:  startTimeMin,
+				StartTimeMax:  startTimeMax,
+				DurationMin:   time.Millisecond,
+				DurationMax:   time.Second,
+				NumTraces:     50,
+				Tags:          map[string]string{"http.status_code": "500", "error": "true"},
+			},
+			serviceNames: []string{"cart"},
+			sql: selectTraceIDs + forceIndex + " WHERE service_name = ? AND operation_name = ? AND start_time <= ?" +
+				" AND start_time >= ? AND duration <= ? AND duration >= ? AND http_code = ? AND error = ?" + groupAndLimit,
+			args: []interface{}{"cart", "GET /cart", int64(1500003600000000), int64(1500000000000000),
+				int64(1000000), int64(1000), 500, true, 50},
+		},
+		{
+			name:  "tag without a place to search it",
+			query: spanstore.TraceQueryParameters{Tags: map[string]string{"customer_id": "42"}},
+			sql:   selectTraceIDs + forceIndex + groupAndLimit,
+			args:  []interface{}{20},
+		},
+		{
+			name:   "promoted tag",
+			query:  spanstore.TraceQueryParameters{Tags: map[string]string{"http.method": "POST"}},
+			search: tagSearch{promoted: mustPromoted(t, "http.method"), tagIndex: NewTagIndex(nil, nil)},
+			sql:    selectTraceIDs + forceIndex + " WHERE tag_http_method = ?" + groupAndLimit,
+			args:   []interface{}{"POST", 20},
+		},
+		{
+			name: "span_tags with the time range",
+			query: spanstore.TraceQueryParameters{StartTimeMin: startTimeMin,
+				Tags: map[string]string{"customer_id": "42", "db.type": "sql"}},
+			search: tagSearch{tagIndex: NewTagIndex(nil, nil)},
+			sql: selectTraceIDs + forceIndex + " WHERE start_time >= ?" +
+				" AND (trace_id, span_hash) IN (SELECT trace_id, span_hash FROM span_tags WHERE tag_key = ? AND tag_value = ? AND start_time >= ?)" +
+				" AND (trace_id, span_hash) IN (SELECT trace_id, span_hash FROM span_tags WHERE tag_key = ? AND tag_value = ? AND start_time >= ?)" +
+				groupAndLimit,
+			args: []interface{}{int64(1500000000000000), "customer_id", "42", int64(1500000000000000),
+				"db.type", "sql", int64(1500000000000000), 20},
+		},
+		{
+			// a trace with http.method=POST on one span and customer_id=42 on another one does not match
+			name:   "promoted and span_tags tags on the same span",
+			query:  spanstore.TraceQueryParameters{Tags: map[string]string{"http.method": "POST", "customer_id": "42"}},
+			search: tagSearch{promoted: mustPromoted(t, "http.method"), tagIndex: NewTagIndex(nil, nil)},
+			sql: selectTraceIDs + forceIndex +
+				" WHERE (trace_id, span_hash) IN (SELECT trace_id, span_hash FROM span_tags WHERE tag_key = ? AND tag_value = ?)" +
+				" AND tag_http_method = ?" + groupAndLimit,
+			args: []interface{}{"customer_id", "42", "POST", 20},
+		},
+		{
+			name:   "json tag",
+			query:  spanstore.TraceQueryParameters{Tags: map[string]string{"retries": "3"}},
+			search: tagSearch{jsonTags: true, tagIndex: NewTagIndex(nil, nil)},
+			sql: selectTraceIDs + " WHERE ? MEMBER OF(tag_keys) AND (JSON_CONTAINS(tags, ?)" +
+				" OR JSON_CONTAINS(process, ?, '$.tags') OR JSON_CONTAINS(tags, ?) OR JSON_CONTAINS(process, ?, '$.tags')" +
+				" OR JSON_CONTAINS(tags, ?) OR JSON_CONTAINS(process, ?, '$.tags'))" + groupAndLimit,
+			args: []interface{}{"retries",
+				`{"key":"retries","v_str":"3"}`, `{"key":"retries","v_str":"3"}`,
+				`{"key":"retries","v_int64":3}`, `{"key":"retries","v_int64":3}`,
+				`{"key":"retries","v_float64":3}`, `{"key":"retries","v_float64":3}`, 20},
+		},
+		{
+			name:   "full-text",
+			query:  spanstore.TraceQueryParameters{Tags: map[string]string{TextSearchTag: `connection "refused"`}},
+			search: tagSearch{fullText: true},
+			sql:    selectTraceIDs + " WHERE MATCH(search_text) AGAINST(? IN BOOLEAN MODE)" + groupAndLimit,
+			args:   []interface{}{`"connection  refused "`, 20},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sql, args, err := buildTraceIDsQuery(&test.query, test.serviceNames, test.search)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sql != test.sql {
+				t.Errorf("sql\n got: %s\nwant: %s", sql, test.sql)
+			}
+			if !reflect.DeepEqual(args, test.args) {
+				t.Errorf("args\n got: %#v\nwant: %#v", args, test.args)
+			}
+		})
+	}
+}
+
+func TestBuildTraceIDsQueryErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		tags   map[string]string
+		search tagSearch
+	}{
+		{name: "http code not a number", tags: map[string]string{"http.status_code": "500 OR 1=1"}},
+		{name: "error not a bool", tags: map[string]string{"error": "1) OR (1=1"}},
+		{name: "full-text disabled", tags: map[string]string{TextSearchTag: "timeout"}},
+		{
+			name:   "tag not indexed",
+			tags:   map[string]string{"password": "secret"},
+			search: tagSearch{tagIndex: NewTagIndex(nil, []string{"password"})},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := spanstore.TraceQueryParameters{Tags: test.tags}
+			if _, _, err := buildTraceIDsQuery(&query, nil, test.search); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestBuildTraceIDsQueryHostileInput(t *testing.T) {
+	hostile := []string{
+		`' OR '1'='1`,
+		`x'; DROP TABLE traces; --`,
+		`\' OR 1=1 #`,
+		`") OR ("1"="1`,
+		"tab\tnew\nline\x00nul",
+		`O'Reilly`,
+	}
+	searches := map[string]tagSearch{
+		"span_tags": {tagIndex: NewTagIndex(nil, nil)},
+		"json":      {jsonTags: true},
+		"promoted":  {promoted: mustPromoted(t, "customer")},
+	}
+	for name, search := range searches {
+		search.fullText = true
+		for _, value := range hostile {
+			query := spanstore.TraceQueryParameters{
+				ServiceName:   value,
+				OperationName: value,
+				Tags:          map[string]string{"customer": value, value: value, TextSearchTag: value},
+			}
+			sql, args, err := buildTraceIDsQuery(&query, []string{value, "other"}, search)
+			if err != nil {
+				t.Fatalf("%s %q: %v", name, value, err)
+			}
+			if strings.Contains(sql, value) || strings.Contains(sql, "'1'") || strings.Contains(sql, "DROP") ||
+				strings.Contains(sql, "Reilly") {
+				t.Errorf("%s: the value %q ends up in the sql: %s", name, value, sql)
+			}
+			if placeholders := strings.Count(sql, "?"); placeholders != len(args) {
+				t.Errorf("%s %q: %d placeholders for %d args", name, value, placeholders, len(args))
+			}
+			found := false
+			for _, arg := range args {
+				if arg == value {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s: the value %q is not passed as an argument", name, value)
+			}
+		}
+	}
+}
+
+// TestBuildTraceIDsQueryCombinations checks every combination of the query parameters
+func TestBuildTraceIDsQueryCombinations(t *testing.T) {
+	type parameter struct {
+		condition string
+		set       func(*spanstore.TraceQueryParameters)
+	}
+	parameters := []parameter{
+		{"service_name = ?", func(q *spanstore.TraceQueryParameters) { q.ServiceName = "cart" }},
+		{"operation_name = ?", func(q *spanstore.TraceQueryParameters) { q.OperationName = "GET /cart" }},
+		{"start_time <= ?", func(q *spanstore.TraceQueryParameters) { q.StartTimeMax = startTimeMax }},
+		{"start_time >= ?", func(q *spanstore.TraceQueryParameters) { q.StartTimeMin = startTimeMin }},
+		{"duration <= ?", func(q *spanstore.TraceQueryParameters) { q.DurationMax = time.Second }},
+		{"duration >= ?", func(q *spanstore.TraceQueryParameters) { q.DurationMin = time.Millisecond }},
+		{"http_code = ?", func(q *spanstore.TraceQueryParameters) { q.Tags["http.status_code"] = "503" }},
+		{"error = ?", func(q *spanstore.TraceQueryParameters) { q.Tags["error"] = "false" }},
+		{"span_tags", func(q *spanstore.TraceQueryParameters) { q.Tags["customer_id"] = "42" }},
+		{"MATCH(search_text)", func(q *spanstore.TraceQueryParameters) { q.Tags[TextSearchTag] = "timeout" }},
+	}
+	search := tagSearch{tagIndex: NewTagIndex(nil, nil), fullText: true}
+	for mask := 0; mask < 1<<uint(len(parameters)); mask++ {
+		query := spanstore.TraceQueryParameters{Tags: map[string]string{}}
+		for i, p := range parameters {
+			if mask&(1<<uint(i)) != 0 {
+				p.set(&query)
+			}
+		}
+		if mask%3 == 0 {
+			query.NumTraces = mask + 1
+		}
+		var serviceNames []string
+		if query.ServiceName != "" {
+			serviceNames = []string{query.ServiceName}
+		}
+		sql, args, err := buildTraceIDsQuery(&query, serviceNames, search)
+		if err != nil {
+			t.Fatalf("%+v: %v", query, err)
+		}
+		for i, p := range parameters {
+			if set := mask&(1<<uint(i)) != 0; strings.Contains(sql, p.condition) != set {
+				t.Errorf("%+v: condition %q present %v, want %v in %s", query, p.condition, !set, set, sql)
+			}
+		}
+		if !strings.HasPrefix(sql, selectTraceIDs) || !strings.HasSuffix(sql, groupAndLimit) {
+			t.Errorf("%+v: unexpected query %s", query, sql)
+		}
+		if placeholders := strings.Count(sql, "?"); placeholders != len(args) {
+			t.Errorf("%+v: %d placeholders for %d args in %s", query, placeholders, len(args), sql)
+		}
+		limit := defaultNumTraces
+		if query.NumTraces > 0 {
+			limit = query.NumTraces
+		}
+		if args[len(args)-1] != limit {
+			t.Errorf("%+v: limit %v, want %d", query, args[len(args)-1], limit)
+		}
+	}
+}
+
+func TestBuildTracesQuery(t *testing.T) {
+	sql, args := buildTracesQuery([]model.TraceID{model.NewTraceID(0, 0xabc), model.NewTraceID(1, 2)})
+	if want := queryTraceByTraceIds + "(?, ?)"; sql != want {
+		t.Errorf("sql\n got: %s\nwant: %s", sql, want)
+	}
+	want := []interface{}{model.NewTraceID(0, 0xabc).String(), model.NewTraceID(1, 2).String()}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args\n got: %#v\nwant: %#v", args, want)
+	}
+}
+
+func TestTextConditionOperators(t *testing.T) {
+	condition, args := textCondition(`+fatal -"retry" (a*) <b> ~c @2 it's`)
+	if condition != "MATCH(search_text) AGAINST(? IN BOOLEAN MODE)" {
+		t.Errorf("unexpected condition %s", condition)
+	}
+	want := []interface{}{`" fatal   retry   a    b   c  2 it's"`}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args\n got: %#v\nwant: %#v", args, want)
+	}
+}
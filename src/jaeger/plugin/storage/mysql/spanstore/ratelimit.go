@@ -0,0 +1,154 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// ErrRateLimited is returned by WriteSpan when the service of the span is over its rate limit
+var ErrRateLimited = errors.New("span rate limit exceeded")
+
+// RateLimit is a token bucket: Rate spans per second on average, bursts up to Burst spans.
+// A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		// a bucket must hold at least one span, a second worth of spans by default
+		burst = limit.Rate
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &tokenBucket{rate: limit.Rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (t *tokenBucket) allow(now time.Time) bool {
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// RateLimiter keeps one token bucket per service, plus one per operation for the operations
+// with a limit of their own, checked on top of the service bucket
+type RateLimiter struct {
+	defaultLimit RateLimit
+	services     map[string]RateLimit
+	operations   map[string]map[string]RateLimit
+	// rejectedCounter returns the counter of the spans rejected for a service
+	rejectedCounter func(service string) metrics.Counter
+
+	lock             sync.Mutex
+	serviceBuckets   map[string]*tokenBucket
+	operationBuckets map[string]map[string]*tokenBucket
+	rejected         map[string]metrics.Counter
+}
+
+func NewRateLimiter(defaultLimit RateLimit, services map[string]RateLimit, operations map[string]map[string]RateLimit,
+	rejectedCounter func(service string) metrics.Counter) *RateLimiter {
+	return &RateLimiter{
+		defaultLimit:     defaultLimit,
+		services:         services,
+		operations:       operations,
+		rejectedCounter:  rejectedCounter,
+		serviceBuckets:   map[string]*tokenBucket{},
+		operationBuckets: map[string]map[string]*tokenBucket{},
+		rejected:         map[string]metrics.Counter{},
+	}
+}
+
+// Allow takes a token for the span of the given service and operation, it reports false when none is left
+func (r *RateLimiter) Allow(service string, operation string) bool {
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if bucket := r.operationBucket(service, operation); bucket != nil && !bucket.allow(now) {
+		r.reject(service)
+		return false
+	}
+	if bucket := r.serviceBucket(service); bucket != nil && !bucket.allow(now) {
+		r.reject(service)
+		return false
+	}
+	return true
+}
+
+// serviceBucket returns the bucket of the service, nil when the service is not limited
+func (r *RateLimiter) serviceBucket(service string) *tokenBucket {
+	if bucket, ok := r.serviceBuckets[service]; ok {
+		return bucket
+	}
+	limit, ok := r.services[service]
+	if !ok {
+		limit = r.defaultLimit
+	}
+	var bucket *tokenBucket
+	if limit.Rate > 0 {
+		bucket = newTokenBucket(limit)
+	}
+	r.serviceBuckets[service] = bucket
+	return bucket
+}
+
+// operationBucket returns the bucket of the operation, nil when the operation has no limit of its own
+func (r *RateLimiter) operationBucket(service string, operation string) *tokenBucket {
+	limit, ok := r.operations[service][operation]
+	if !ok || limit.Rate <= 0 {
+		return nil
+	}
+	buckets, ok := r.operationBuckets[service]
+	if !ok {
+		buckets = map[string]*tokenBucket{}
+		r.operationBuckets[service] = buckets
+	}
+	bucket, ok := buckets[operation]
+	if !ok {
+		bucket = newTokenBucket(limit)
+		buckets[operation] = bucket
+	}
+	return bucket
+}
+
+func (r *RateLimiter) reject(service string) {
+	counter, ok := r.rejected[service]
+	if !ok {
+		counter = r.rejectedCounter(service)
+		r.rejected[service] = counter
+	}
+	counter.Inc(1)
+}
@@ -18,9 +18,6 @@ package spanstore
 import (
 	"context"
 	"database/sql"
-	"fmt"
-	"time"
-	"strings"
 
 	_ "github.com/go-sql-driver/mysql"
 	"go.uber.org/zap"
@@ -30,25 +27,43 @@ import (
 	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
 )
 
+// spanKey identifies a span row, duplicated rows share the same key
+type spanKey struct {
+	traceID  string
+	spanHash int64
+}
+
 // Store is an in-memory store of traces
 type SpanReader struct {
 	mysql_client  *sql.DB
 	cache         *CacheStore
+	// aliases merges the old names of the renamed services into their canonical name when not nil
+	aliases       *ServiceAliases
+	// search tells where FindTraceIDs looks for the tags
+	search        tagSearch
 	logger        *zap.Logger
 }
 
-func NewSpanReader(store *sql.DB, cacheStore *CacheStore, logger *zap.Logger) *SpanReader{
+func NewSpanReader(store *sql.DB, cacheStore *CacheStore, aliases *ServiceAliases, tagIndex *TagIndex,
+	promoted *PromotedTags, schema string, fullText bool, logger *zap.Logger) *SpanReader{
 	return &SpanReader{
 		mysql_client: store,
 		cache: cacheStore, 
+		aliases: aliases,
+		search: tagSearch{
+			promoted: promoted,
+			jsonTags: schema == SchemaJSON,
+			tagIndex: tagIndex,
+			fullText: fullText,
+		},
 		logger: logger,
 	}
 }
 
 // Close closes SpanWriter
 func (r *SpanReader) Close() error {
-	r.mysql_client.Close()
 	r.cache.Close()
+	r.mysql_client.Close()
 	return nil
 }
 
@@ -63,10 +78,12 @@ func (r *SpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*mode
 	}
 	defer rows.Close()
 	var spans []*model.Span
+	seen := map[int64]struct{}{}
 	for rows.Next() {
 		dbspan := new(dbmodel.Span)
 		err := rows.Scan(&dbspan.TraceID, 
 						 &dbspan.SpanID, 
+						 &dbspan.SpanHash, 
 						 &dbspan.ParentID, 
 						 &dbspan.OperationName, 
 						 &dbspan.Flags, 
@@ -79,6 +96,11 @@ func (r *SpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*mode
 		if err != nil {
 			r.logger.Error("queryTrace scan err", zap.Error(err))
 		}
+		// rows written before span_hash was unique may be duplicated
+		if _, ok := seen[dbspan.SpanHash]; ok {
+			continue
+		}
+		seen[dbspan.SpanHash] = struct{}{}
 		span, err := dbmodel.ToDomain(dbspan)
 		if err != nil {
 			r.logger.Error("queryTrace scan err", zap.Error(err))
@@ -92,12 +114,44 @@ func (r *SpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*mode
 
 // GetServices returns a list of all known services
 func (r *SpanReader) GetServices(ctx context.Context) ([]string, error){
-	return r.cache.LoadServices()
+	services, err := r.cache.LoadServices()
+	if err != nil || r.aliases == nil {
+		return services, err
+	}
+	// the old names are listed under their canonical name
+	var canonical []string
+	seen := map[string]struct{}{}
+	for _, service := range services {
+		service = r.aliases.Canonical(service)
+		if _, ok := seen[service]; !ok {
+			seen[service] = struct{}{}
+			canonical = append(canonical, service)
+		}
+	}
+	return canonical, nil
 }
 
-// GetOperations returns the operations of a given service
-func (r *SpanReader) GetOperations(ctx context.Context, service string) ([]string, error){
-	return r.cache.LoadOperations(service)
+// GetOperations returns the operations of a given service, only the ones of the given span kind if any
+func (r *SpanReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error){
+	if r.aliases == nil {
+		return r.cache.LoadOperations(query)
+	}
+	var operations []spanstore.Operation
+	seen := map[spanstore.Operation]struct{}{}
+	for _, service := range r.aliases.Names(query.ServiceName) {
+		query.ServiceName = service
+		serviceOperations, err := r.cache.LoadOperations(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, operation := range serviceOperations {
+			if _, ok := seen[operation]; !ok {
+				seen[operation] = struct{}{}
+				operations = append(operations, operation)
+			}
+		}
+	}
+	return operations, nil
 }
 
 // FindTraces returns all traces in the query parameters are satisfied by a trace's span
@@ -112,27 +166,22 @@ func (r *SpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQuery
 		return nil, nil
 	}
 
-	var traceIdsStr string = ""
-	for _,trace_id := range traceIds {
-		if traceIdsStr != "" {
-			traceIdsStr = traceIdsStr + ","
-		}
-		traceIdsStr = traceIdsStr + "'" + trace_id.String() + "'"
-	}
 	traces_map := make(map[string][]*model.Span)
-	SQL := queryTraceByTraceIds + "(" + traceIdsStr + ")"
+	seen := make(map[spanKey]struct{})
+	SQL, args := buildTracesQuery(traceIds)
 	//r.logger.Info("FindTraces query sql", zap.String("SQL", SQL))
 
-	rows, err := r.mysql_client.Query(SQL)
-	defer rows.Close()
+	rows, err := r.mysql_client.Query(SQL, args...)
 	if err != nil {
 		r.logger.Error("FindTraces err", zap.Error(err))
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		dbspan := new(dbmodel.Span)
 		err := rows.Scan(&dbspan.TraceID, 
 						 &dbspan.SpanID, 
+						 &dbspan.SpanHash, 
 						 &dbspan.ParentID, 
 						 &dbspan.OperationName, 
 						 &dbspan.Flags, 
@@ -145,6 +194,12 @@ func (r *SpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQuery
 		if err != nil {
 			r.logger.Error("queryTrace scan err", zap.Error(err))
 		}
+		// rows written before span_hash was unique may be duplicated
+		key := spanKey{traceID: dbspan.TraceID, spanHash: dbspan.SpanHash}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
 		spans, ok := traces_map[dbspan.TraceID]
 		if !ok {
 			spans = []*model.Span{}
@@ -169,14 +224,24 @@ func (r *SpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQuery
 
 // FindTraceIDs 
 func (r *SpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error){
-	defaultQuery := gen_query_sql(query)
+	var serviceNames []string
+	if query.ServiceName != "" {
+		serviceNames = []string{query.ServiceName}
+		if r.aliases != nil {
+			serviceNames = r.aliases.Names(query.ServiceName)
+		}
+	}
+	defaultQuery, args, err := buildTraceIDsQuery(query, serviceNames, r.search)
+	if err != nil {
+		return nil, err
+	}
 	r.logger.Info("defauleQuerySql", zap.String("SQL", defaultQuery))
-	rows, err := r.mysql_client.Query(defaultQuery)
-	defer rows.Close()
+	rows, err := r.mysql_client.Query(defaultQuery, args...)
 	if err != nil {
 		r.logger.Error("queryTraceIDs err", zap.Error(err))
 		return nil, err
 	}
+	defer rows.Close()
 	var traceIds []model.TraceID
 	var traceIdStr string
 	for rows.Next() {
@@ -193,53 +258,3 @@ func (r *SpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQue
 	}
 	return traceIds, nil
 }
-
-func gen_query_sql(query *spanstore.TraceQueryParameters) string {
-	// TODO need more graceful
-	defaultQuery := "SELECT trace_id, min(start_time) as start_time FROM traces force index(idx_time_svc_operation)"
-	// add condition
-	var conditions []string
-	if query.ServiceName != ""{
-		conditions = append(conditions, fmt.Sprintf("service_name='%s'", query.ServiceName))
-	}
-	if query.OperationName != ""{
-		conditions = append(conditions, fmt.Sprintf("operation_name='%s'", query.OperationName))
-	}
-	var t time.Time
-	if query.StartTimeMax != t {
-		start_time_max := int64(model.TimeAsEpochMicroseconds(query.StartTimeMax))
-		conditions = append(conditions, fmt.Sprintf("start_time<=%d", start_time_max))
-	}
-	if query.StartTimeMin != t {
-		start_time_min := int64(model.TimeAsEpochMicroseconds(query.StartTimeMin))
-		conditions = append(conditions, fmt.Sprintf("start_time>=%d", start_time_min))
-	}
-	if query.DurationMax > 0 {
-		duration_max := int64(model.DurationAsMicroseconds(query.DurationMax))
-		conditions = append(conditions, fmt.Sprintf("duration<=%d", duration_max))
-	}
-	if query.DurationMin > 0 {
-		duration_min := int64(model.DurationAsMicroseconds(query.DurationMin))
-		conditions = append(conditions, fmt.Sprintf("duration>=%d", duration_min))
-	}
-	if http_code, ok := query.Tags["http.status_code"]; ok {
-		conditions = append(conditions, fmt.Sprintf("http_code=%s", http_code))
-	}
-	if isError, ok := query.Tags["error"]; ok {
-		conditions = append(conditions, fmt.Sprintf("error=%v", isError))
-	}
-
-	if len(conditions) > 0{
-		defaultQuery = defaultQuery + " where " + strings.Join(conditions, " AND ")
-	}
-
-	// add group by
-	defaultQuery = defaultQuery + " group by trace_id"
-	// default 20 if no query params
-	limit := query.NumTraces
-	if limit <= 0 {
-		limit = 20
-	}
-	defaultQuery = fmt.Sprintf("SELECT trace_id FROM (%s) as tmp order by start_time desc limit %d", defaultQuery, limit)
-	return defaultQuery
-}
\ No newline at end of file
@@ -0,0 +1,139 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysql server error numbers that are worth retrying, everything else reported by the server is fatal
+var retriableErrorNumbers = map[uint16]struct{}{
+	1040: {}, // ER_CON_COUNT_ERROR, too many connections
+	1053: {}, // ER_SERVER_SHUTDOWN
+	1205: {}, // ER_LOCK_WAIT_TIMEOUT
+	1213: {}, // ER_LOCK_DEADLOCK
+	1290: {}, // ER_OPTION_PREVENTS_STATEMENT, read only while failing over
+	1317: {}, // ER_QUERY_INTERRUPTED
+	1927: {}, // ER_CONNECTION_KILLED
+}
+
+// packetTooLarge is the reject reason of the spans exceeding max_allowed_packet
+const packetTooLarge = "packet_too_large"
+
+// mysql server error numbers caused by the content of a row, retrying the same rows never helps
+var dataErrorNumbers = map[uint16]string{
+	1048: "null_value",             // ER_BAD_NULL_ERROR
+	1062: "duplicate_entry",        // ER_DUP_ENTRY, span already stored while idempotent writes are off
+	1153: packetTooLarge,           // ER_NET_PACKET_TOO_LARGE
+	1264: "out_of_range",           // ER_WARN_DATA_OUT_OF_RANGE
+	1265: "data_truncated",         // WARN_DATA_TRUNCATED
+	1292: "incorrect_value",        // ER_TRUNCATED_WRONG_VALUE
+	1300: "invalid_character",      // ER_INVALID_CHARACTER_STRING
+	1366: "incorrect_string_value", // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD, e.g. invalid utf8
+	1406: "data_too_long",          // ER_DATA_TOO_LONG
+	3140: "invalid_json",           // ER_INVALID_JSON_TEXT, the JSON columns of sql/full_mysql8.sql
+	3141: "invalid_json",           // ER_INVALID_JSON_TEXT_IN_PARAM
+}
+
+// SpanRejectReasons lists the reasons a single span can be rejected for
+func SpanRejectReasons() []string {
+	reasons := make([]string, 0, len(dataErrorNumbers))
+	seen := map[string]struct{}{}
+	for _, reason := range dataErrorNumbers {
+		// several error numbers share a reason
+		if _, ok := seen[reason]; !ok {
+			seen[reason] = struct{}{}
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons
+}
+
+// RetryPolicy describes how a failed batch insert is retried
+type RetryPolicy struct {
+	// Attempts is the total number of tries, including the first one
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+func NewRetryPolicy(attempts int, initialBackoff int, maxBackoff int) RetryPolicy {
+	return RetryPolicy{
+		Attempts:       attempts,
+		InitialBackoff: time.Duration(initialBackoff) * time.Millisecond,
+		MaxBackoff:     time.Duration(maxBackoff) * time.Millisecond,
+	}
+}
+
+// Backoff returns the wait before the given retry (0 based): exponential growth capped
+// by MaxBackoff, with the upper half randomized so that workers do not retry in lockstep
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 0; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
+// mysqlErrorNumber returns the server error number of err, 0 if err was not reported by the server
+func mysqlErrorNumber(err error) uint16 {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number
+	}
+	return 0
+}
+
+// isDataError reports whether the insert was rejected because of the content of some rows
+func isDataError(err error) bool {
+	_, ok := dataErrorNumbers[mysqlErrorNumber(err)]
+	return ok
+}
+
+// spanRejectReason returns the reason a single span was rejected for, see SpanRejectReasons
+func spanRejectReason(err error) string {
+	if errors.Is(err, ErrSpanTooLarge) {
+		return packetTooLarge
+	}
+	return dataErrorNumbers[mysqlErrorNumber(err)]
+}
+
+// isRetriableError reports whether a failed insert may succeed when tried again
+func isRetriableError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		_, ok := retriableErrorNumbers[mysqlErr.Number]
+		return ok
+	}
+	// the connection broke before the server could answer
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
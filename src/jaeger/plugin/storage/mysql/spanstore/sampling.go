@@ -0,0 +1,190 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/uber/jaeger-lib/metrics"
+	"gopkg.in/yaml.v2"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+// SamplingRule sets the share of the traces kept for a service, or one operation of a service
+type SamplingRule struct {
+	Service string `yaml:"service"`
+	// Operation is optional, empty matches every operation of the service
+	Operation string `yaml:"operation"`
+	// Percentage of the traces kept, from 0 to 100
+	Percentage float64 `yaml:"percentage"`
+	// SlowDuration overrides the default slow span duration, in milliseconds
+	SlowDuration int64 `yaml:"slowDuration"`
+}
+
+// SamplingRules is the content of the sampling rules file, e.g.
+//
+//	defaultPercentage: 100
+//	slowDuration: 1000
+//	decisionWindow: 10000
+//	rules:
+//	  - service: frontend
+//	    operation: GET /health
+//	    percentage: 1
+//	  - service: cart
+//	    percentage: 10
+//
+// A trace is decided by its first span: kept when the span has an error, a 5xx http code or the debug
+// flag, or lasts at least slowDuration, otherwise by the percentage of the first rule matching the span,
+// or defaultPercentage. The decision applies to the spans of the trace arriving within decisionWindow
+// milliseconds of the previous one. An error or slow span turns a dropped trace into a kept one from then
+// on, the spans dropped before it are lost: use the tail sampling to keep whole traces with errors.
+type SamplingRules struct {
+	DefaultPercentage *float64       `yaml:"defaultPercentage"`
+	SlowDuration      int64          `yaml:"slowDuration"`
+	DecisionWindow    int64          `yaml:"decisionWindow"`
+	Rules             []SamplingRule `yaml:"rules"`
+}
+
+// defaultDecisionWindow is the decisionWindow of the rules not setting it
+const defaultDecisionWindow = 10 * time.Second
+
+// LoadSamplingRules reads and checks the sampling rules file
+func LoadSamplingRules(path string) (*SamplingRules, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := &SamplingRules{}
+	if err := yaml.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("parse sampling rules %s: %v", path, err)
+	}
+	if rules.DefaultPercentage != nil && (*rules.DefaultPercentage < 0 || *rules.DefaultPercentage > 100) {
+		return nil, fmt.Errorf("sampling rules %s: defaultPercentage %v is not between 0 and 100", path, *rules.DefaultPercentage)
+	}
+	if rules.DecisionWindow < 0 {
+		return nil, fmt.Errorf("sampling rules %s: decisionWindow %d is negative", path, rules.DecisionWindow)
+	}
+	for i, rule := range rules.Rules {
+		if rule.Service == "" {
+			return nil, fmt.Errorf("sampling rules %s: rule %d has no service", path, i)
+		}
+		if rule.Percentage < 0 || rule.Percentage > 100 {
+			return nil, fmt.Errorf("sampling rules %s: rule %d percentage %v is not between 0 and 100", path, i, rule.Percentage)
+		}
+	}
+	return rules, nil
+}
+
+// Sampler decides at write time which spans are stored, once per trace: the decision made on the first
+// span of a trace is remembered and applied to its other spans, whatever their service.
+type Sampler struct {
+	rules        *SamplingRules
+	window       time.Duration
+	keptCount    metrics.Counter
+	droppedCount metrics.Counter
+
+	lock    sync.Mutex
+	decided map[string]samplingDecision
+	// pruned is when the expired decisions were last removed
+	pruned time.Time
+}
+
+type samplingDecision struct {
+	keep    bool
+	expires time.Time
+}
+
+func NewSampler(rules *SamplingRules, keptCounter metrics.Counter, droppedCounter metrics.Counter) *Sampler {
+	window := time.Duration(rules.DecisionWindow) * time.Millisecond
+	if window == 0 {
+		window = defaultDecisionWindow
+	}
+	return &Sampler{
+		rules:        rules,
+		window:       window,
+		keptCount:    keptCounter,
+		droppedCount: droppedCounter,
+		decided:      map[string]samplingDecision{},
+		pruned:       time.Now(),
+	}
+}
+
+// Keep reports whether the span is stored, with the decision of its trace
+func (s *Sampler) Keep(span *dbmodel.Span) bool {
+	if s.keep(span, time.Now()) {
+		s.keptCount.Inc(1)
+		return true
+	}
+	s.droppedCount.Inc(1)
+	return false
+}
+
+func (s *Sampler) keep(span *dbmodel.Span, now time.Time) bool {
+	percentage, slowDuration := s.match(span)
+	// span durations are in microseconds
+	forced := span.Error || span.HttpCode >= 500 || model.Flags(uint32(span.Flags)).IsDebug() ||
+		(slowDuration > 0 && span.Duration >= slowDuration*1000)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	decision, ok := s.decided[span.TraceID]
+	if !ok || now.After(decision.expires) {
+		decision.keep = traceBucket(span.TraceID) < percentage*100
+	}
+	decision.keep = decision.keep || forced
+	decision.expires = now.Add(s.window)
+	s.decided[span.TraceID] = decision
+	if now.Sub(s.pruned) >= s.window {
+		for traceID, decision := range s.decided {
+			if now.After(decision.expires) {
+				delete(s.decided, traceID)
+			}
+		}
+		s.pruned = now
+	}
+	return decision.keep
+}
+
+// match returns the percentage and the slow duration of the span, from its first matching rule
+func (s *Sampler) match(span *dbmodel.Span) (float64, int64) {
+	percentage := float64(100)
+	if s.rules.DefaultPercentage != nil {
+		percentage = *s.rules.DefaultPercentage
+	}
+	slowDuration := s.rules.SlowDuration
+	for _, rule := range s.rules.Rules {
+		if rule.Service == span.ServiceName && (rule.Operation == "" || rule.Operation == span.OperationName) {
+			percentage = rule.Percentage
+			if rule.SlowDuration > 0 {
+				slowDuration = rule.SlowDuration
+			}
+			break
+		}
+	}
+	return percentage, slowDuration
+}
+
+// traceBucket maps a trace id to [0, 10000), the same for every span of the trace whatever its service
+func traceBucket(traceID string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(traceID))
+	return float64(h.Sum64() % 10000)
+}
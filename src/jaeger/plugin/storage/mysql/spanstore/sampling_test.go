@@ -0,0 +1,115 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/uber/jaeger-lib/metrics"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+func newTestSampler(rules *SamplingRules) *Sampler {
+	return NewSampler(rules, metrics.NullCounter, metrics.NullCounter)
+}
+
+// TestSamplerTraceDecision checks the spans of a trace get the decision of its first span, even in
+// services sampled with another percentage
+func TestSamplerTraceDecision(t *testing.T) {
+	s := newTestSampler(&SamplingRules{Rules: []SamplingRule{
+		{Service: "frontend", Percentage: 50},
+		{Service: "cart", Percentage: 10},
+	}})
+	now := time.Now()
+	kept := 0
+	for i := 0; i < 200; i++ {
+		traceID := fmt.Sprintf("trace-%d", i)
+		services := []string{"frontend", "cart", "frontend", "cart"}
+		if i%2 == 1 {
+			services = []string{"cart", "frontend", "cart", "frontend"}
+		}
+		first := s.keep(&dbmodel.Span{TraceID: traceID, ServiceName: services[0]}, now)
+		for j, service := range services[1:] {
+			if keep := s.keep(&dbmodel.Span{TraceID: traceID, ServiceName: service}, now.Add(time.Duration(j)*time.Second)); keep != first {
+				t.Fatalf("%s: span %d in %s kept %v, the first span %v", traceID, j+1, service, keep, first)
+			}
+		}
+		if first {
+			kept++
+		}
+	}
+	if kept == 0 || kept == 200 {
+		t.Errorf("kept %d traces out of 200, the percentages are not applied", kept)
+	}
+}
+
+// TestSamplerForcedKeep checks an error or slow span keeps the rest of its trace
+func TestSamplerForcedKeep(t *testing.T) {
+	zero := float64(0)
+	s := newTestSampler(&SamplingRules{DefaultPercentage: &zero, SlowDuration: 1000})
+	now := time.Now()
+	for _, forced := range []*dbmodel.Span{
+		{TraceID: "error", Error: true},
+		{TraceID: "http", HttpCode: 503},
+		{TraceID: "slow", Duration: 2000 * 1000},
+	} {
+		if s.keep(&dbmodel.Span{TraceID: forced.TraceID}, now) {
+			t.Fatalf("%s: kept a span at 0%%", forced.TraceID)
+		}
+		if !s.keep(forced, now) {
+			t.Errorf("%s: dropped the forced span", forced.TraceID)
+		}
+		if !s.keep(&dbmodel.Span{TraceID: forced.TraceID}, now) {
+			t.Errorf("%s: dropped a span after the forced one", forced.TraceID)
+		}
+	}
+}
+
+// TestSamplerDecisionWindow checks the decisions are forgotten decisionWindow after the last span of the trace
+func TestSamplerDecisionWindow(t *testing.T) {
+	zero := float64(0)
+	s := newTestSampler(&SamplingRules{DefaultPercentage: &zero, DecisionWindow: 1000})
+	now := time.Now()
+	s.keep(&dbmodel.Span{TraceID: "trace", Error: true}, now)
+	if !s.keep(&dbmodel.Span{TraceID: "trace"}, now.Add(900*time.Millisecond)) {
+		t.Error("dropped a span within the window")
+	}
+	if !s.keep(&dbmodel.Span{TraceID: "trace"}, now.Add(1800*time.Millisecond)) {
+		t.Error("dropped a span within the window of the previous span")
+	}
+	if s.keep(&dbmodel.Span{TraceID: "trace"}, now.Add(3*time.Second)) {
+		t.Error("kept a span after the window")
+	}
+	s.keep(&dbmodel.Span{TraceID: "other"}, now.Add(5*time.Second))
+	if _, ok := s.decided["trace"]; ok {
+		t.Error("expired decision not removed")
+	}
+}
+
+func TestTraceBucket(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		traceID := fmt.Sprintf("%032x", i*7919)
+		bucket := traceBucket(traceID)
+		if bucket < 0 || bucket >= 10000 {
+			t.Fatalf("%s: bucket %v out of [0, 10000)", traceID, bucket)
+		}
+		if again := traceBucket(traceID); again != bucket {
+			t.Fatalf("%s: bucket %v then %v", traceID, bucket, again)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/uber/jaeger-lib/metrics"
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+const (
+	segmentSuffix = ".seg"
+	// every record is prefixed by its payload length and the crc32 of the payload
+	recordHeaderSize = 8
+	// anything larger is a corrupted length prefix, no span gets close to it
+	maxRecordSize = 64 << 20
+)
+
+// ErrSpillFull is returned when the spill queue reached its size cap
+var ErrSpillFull = errors.New("spill queue is full")
+
+// SpillMetrics holds the counters reported by the spill queue
+type SpillMetrics struct {
+	spilledSpanCount   metrics.Counter
+	replayedSpanCount  metrics.Counter
+	discardedSpanCount metrics.Counter
+}
+
+func NewSpillMetrics(spilled metrics.Counter, replayed metrics.Counter, discarded metrics.Counter) SpillMetrics {
+	return SpillMetrics{
+		spilledSpanCount:   spilled,
+		replayedSpanCount:  replayed,
+		discardedSpanCount: discarded,
+	}
+}
+
+// SpillQueue is a disk backed FIFO of spans used when the in-memory eventQueue is full.
+// Spans are appended to segment files under dir; segments are removed once they are fully replayed.
+type SpillQueue struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	logger       *zap.Logger
+	SpillMetrics
+
+	lock       sync.Mutex
+	segments   []uint64 // sequence numbers of the segments on disk, oldest first
+	totalBytes int64
+
+	writeFile *os.File
+	writeSeq  uint64
+	writeSize int64
+
+	readFile   *os.File
+	readReader *bufio.Reader
+	readSeq    uint64
+	readOffset int64
+}
+
+// NewSpillQueue opens (or creates) the spill directory and picks up segments left by a previous run
+func NewSpillQueue(dir string, maxBytes int64, segmentBytes int64, logger *zap.Logger, spillMetrics SpillMetrics) (*SpillQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &SpillQueue{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		logger:       logger,
+		SpillMetrics: spillMetrics,
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			logger.Warn("ignore unknown file in spill dir", zap.String("file", name))
+			continue
+		}
+		q.segments = append(q.segments, seq)
+		q.totalBytes += entry.Size()
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+	if len(q.segments) > 0 {
+		// never append to a segment of a previous run, its tail may be torn
+		q.writeSeq = q.segments[len(q.segments)-1] + 1
+		logger.Info("found spilled spans on disk", zap.Int("segments", len(q.segments)), zap.Int64("bytes", q.totalBytes))
+	}
+	return q, nil
+}
+
+func (q *SpillQueue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// Empty reports whether every spilled span has been replayed
+func (q *SpillQueue) Empty() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.segments) == 0 {
+		return true
+	}
+	if len(q.segments) > 1 || q.segments[0] != q.writeSeq || q.writeFile == nil {
+		return false
+	}
+	var consumed int64
+	if q.readFile != nil && q.readSeq == q.writeSeq {
+		consumed = q.readOffset
+	}
+	return consumed >= q.writeSize
+}
+
+// Put appends the span to the active segment, returns ErrSpillFull when the size cap is reached
+func (q *SpillQueue) Put(span *dbmodel.Span) error {
+	payload, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	size := int64(recordHeaderSize + len(payload))
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.maxBytes > 0 && q.totalBytes+size > q.maxBytes {
+		q.discardedSpanCount.Inc(1)
+		return ErrSpillFull
+	}
+	if q.writeFile == nil || q.writeSize >= q.segmentBytes {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+	record := make([]byte, size)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+	if _, err := q.writeFile.Write(record); err != nil {
+		return err
+	}
+	q.writeSize += size
+	q.totalBytes += size
+	q.spilledSpanCount.Inc(1)
+	return nil
+}
+
+// rotate closes the active segment and opens a new one, must be called with the lock held
+func (q *SpillQueue) rotate() error {
+	if q.writeFile != nil {
+		if err := q.writeFile.Close(); err != nil {
+			q.logger.Error("close spill segment error", zap.Error(err))
+		}
+		q.writeFile = nil
+		q.writeSeq++
+	}
+	f, err := os.OpenFile(q.segmentPath(q.writeSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	q.writeFile = f
+	q.writeSize = 0
+	q.segments = append(q.segments, q.writeSeq)
+	return nil
+}
+
+// Peek reads at most n spans from the oldest segment without consuming them.
+// The returned offset must be passed to Ack once the spans are safely stored.
+func (q *SpillQueue) Peek(n int) ([]*dbmodel.Span, int64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.segments) > 0 {
+		if err := q.openReader(); err != nil {
+			return nil, 0, err
+		}
+		spans, offset, corrupted := q.readRecords(n)
+		if len(spans) > 0 {
+			// a corrupted tail is detected again once these spans are acked
+			return spans, offset, nil
+		}
+		if corrupted {
+			// the rest of the segment cannot be trusted, skip to the next one
+			q.logger.Warn("corrupted spill segment, discarding the remaining records",
+				zap.String("segment", q.segmentPath(q.readSeq)), zap.Int64("offset", offset))
+			q.discardedSpanCount.Inc(1)
+			q.removeReadSegment()
+			continue
+		}
+		if q.readSeq == q.writeSeq && q.writeFile != nil {
+			// caught up with the writer
+			return nil, offset, nil
+		}
+		q.removeReadSegment()
+	}
+	return nil, 0, nil
+}
+
+// Ack marks every record before offset in the oldest segment as consumed
+func (q *SpillQueue) Ack(offset int64, n int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.readFile == nil {
+		return
+	}
+	q.readOffset = offset
+	q.replayedSpanCount.Inc(int64(n))
+	if q.readSeq == q.writeSeq && q.writeFile != nil {
+		if q.readOffset < q.writeSize {
+			return
+		}
+		// reader consumed the active segment, start a fresh one on the next Put
+		q.writeFile.Close()
+		q.writeFile = nil
+		q.writeSeq++
+	}
+	if info, err := q.readFile.Stat(); err == nil && q.readOffset >= info.Size() {
+		q.removeReadSegment()
+	}
+}
+
+func (q *SpillQueue) openReader() error {
+	seq := q.segments[0]
+	if q.readFile != nil && q.readSeq == seq {
+		if _, err := q.readFile.Seek(q.readOffset, io.SeekStart); err != nil {
+			return err
+		}
+		q.readReader.Reset(q.readFile)
+		return nil
+	}
+	f, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	q.readFile = f
+	q.readReader = bufio.NewReader(f)
+	q.readSeq = seq
+	q.readOffset = 0
+	return nil
+}
+
+// readRecords decodes up to n records starting at readOffset
+func (q *SpillQueue) readRecords(n int) ([]*dbmodel.Span, int64, bool) {
+	var spans []*dbmodel.Span
+	offset := q.readOffset
+	header := make([]byte, recordHeaderSize)
+	for len(spans) < n {
+		// records are written and read under the same lock, so a partial record is a torn write of a crashed run
+		if _, err := io.ReadFull(q.readReader, header); err != nil {
+			return spans, offset, err == io.ErrUnexpectedEOF
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxRecordSize {
+			return spans, offset, true
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(q.readReader, payload); err != nil {
+			return spans, offset, true
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return spans, offset, true
+		}
+		span := new(dbmodel.Span)
+		if err := json.Unmarshal(payload, span); err != nil {
+			return spans, offset, true
+		}
+		spans = append(spans, span)
+		offset += int64(recordHeaderSize) + int64(length)
+	}
+	return spans, offset, false
+}
+
+func (q *SpillQueue) removeReadSegment() {
+	seq := q.segments[0]
+	if q.readFile != nil && q.readSeq == seq {
+		q.readFile.Close()
+		q.readFile = nil
+		q.readReader = nil
+		q.readOffset = 0
+	}
+	path := q.segmentPath(seq)
+	if info, err := os.Stat(path); err == nil {
+		q.totalBytes -= info.Size()
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		q.logger.Error("remove spill segment error", zap.Error(err))
+	}
+	q.segments = q.segments[1:]
+	if len(q.segments) == 0 {
+		q.totalBytes = 0
+	}
+}
+
+// Close closes the open segment files, pending spans stay on disk for the next run
+func (q *SpillQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile = nil
+	}
+	if q.writeFile != nil {
+		return q.writeFile.Close()
+	}
+	return nil
+}
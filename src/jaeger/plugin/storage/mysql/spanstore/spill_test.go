@@ -0,0 +1,192 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uber/jaeger-lib/metrics"
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+func openSpillQueue(t *testing.T, dir string) *SpillQueue {
+	q, err := NewSpillQueue(dir, 0, 1<<20, zap.NewNop(),
+		NewSpillMetrics(metrics.NullCounter, metrics.NullCounter, metrics.NullCounter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// spillSpans puts n spans in a new spill queue under dir and closes it, it returns the segment file
+func spillSpans(t *testing.T, dir string, n int) string {
+	q := openSpillQueue(t, dir)
+	for i := 0; i < n; i++ {
+		if err := q.Put(&dbmodel.Span{TraceID: "abc", SpanID: int64(i), OperationName: "op"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("got segments %v, %v, want one", segments, err)
+	}
+	return segments[0]
+}
+
+// replaySpill reads the spill queue until it is empty and returns the span ids read
+func replaySpill(t *testing.T, q *SpillQueue) []int64 {
+	var ids []int64
+	for i := 0; !q.Empty(); i++ {
+		if i > 100 {
+			t.Fatal("spill queue never gets empty")
+		}
+		spans, offset, err := q.Peek(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, span := range spans {
+			ids = append(ids, span.SpanID)
+		}
+		q.Ack(offset, len(spans))
+	}
+	return ids
+}
+
+func assertSpanIDs(t *testing.T, got []int64, want ...int64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got span ids %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got span ids %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSpillQueueReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spillSpans(t, dir, 5)
+
+	q := openSpillQueue(t, dir)
+	defer q.Close()
+	assertSpanIDs(t, replaySpill(t, q), 0, 1, 2, 3, 4)
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix)); len(segments) != 0 {
+		t.Errorf("replayed segments are left on disk: %v", segments)
+	}
+}
+
+func TestSpillQueueTruncatedTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	segment := spillSpans(t, dir, 3)
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a crash in the middle of the last record
+	if err := os.Truncate(segment, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	q := openSpillQueue(t, dir)
+	defer q.Close()
+	assertSpanIDs(t, replaySpill(t, q), 0, 1)
+}
+
+func TestSpillQueueTruncatedHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	segment := spillSpans(t, dir, 2)
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only a part of the header of a third record made it to disk
+	f.Write([]byte{0, 0, 1})
+	f.Close()
+
+	q := openSpillQueue(t, dir)
+	defer q.Close()
+	assertSpanIDs(t, replaySpill(t, q), 0, 1)
+}
+
+func TestSpillQueueCorruptedRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	segment := spillSpans(t, dir, 4)
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flip a byte in the payload of the third record, its crc no longer matches
+	offset := 0
+	for i := 0; i < 2; i++ {
+		offset += recordHeaderSize + int(binary.BigEndian.Uint32(data[offset:offset+4]))
+	}
+	data[offset+recordHeaderSize+1] ^= 0xff
+	if err := ioutil.WriteFile(segment, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q := openSpillQueue(t, dir)
+	defer q.Close()
+	// the rest of the segment can not be trusted
+	assertSpanIDs(t, replaySpill(t, q), 0, 1)
+}
+
+func TestSpillQueueCorruptedLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	segment := spillSpans(t, dir, 2)
+	data, err := ioutil.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a length prefix beyond maxRecordSize
+	data[0] = 0xff
+	if err := ioutil.WriteFile(segment, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	q := openSpillQueue(t, dir)
+	defer q.Close()
+	assertSpanIDs(t, replaySpill(t, q))
+}
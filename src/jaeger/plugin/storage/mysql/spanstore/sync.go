@@ -0,0 +1,80 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+type syncRequest struct {
+	span   *dbmodel.Span
+	result chan error
+}
+
+// syncBatcher groups the spans of concurrent sync writers into one insert,
+// every writer still gets the error of its own span
+type syncBatcher struct {
+	background *BackgroudStore
+	requests   chan *syncRequest
+}
+
+func newSyncBatcher(background *BackgroudStore) *syncBatcher {
+	s := &syncBatcher{
+		background: background,
+		requests:   make(chan *syncRequest, background.batchSize),
+	}
+	for i := 0; i < background.workers; i++ {
+		go s.run()
+	}
+	return s
+}
+
+func (s *syncBatcher) write(span *dbmodel.Span) error {
+	request := &syncRequest{span: span, result: make(chan error, 1)}
+	s.requests <- request
+	return <-request.result
+}
+
+func (s *syncBatcher) run() {
+	for request := range s.requests {
+		batch := []*syncRequest{request}
+		// take whatever the other writers queued meanwhile, never wait for more
+	collect:
+		for len(batch) < s.background.batchSize {
+			select {
+			case request, ok := <-s.requests:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, request)
+			default:
+				break collect
+			}
+		}
+
+		spans := make([]*dbmodel.Span, len(batch))
+		for i, request := range batch {
+			spans[i] = request.span
+		}
+		for i, err := range s.background.InsertSync(spans) {
+			batch[i].result <- err
+		}
+	}
+}
+
+// close stops the batcher, no write may be in progress
+func (s *syncBatcher) close() {
+	close(s.requests)
+}
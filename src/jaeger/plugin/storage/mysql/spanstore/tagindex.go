@@ -0,0 +1,175 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"github.com/smartwalle/dbs"
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+const (
+	// maxTagKeyLength and maxTagValueLength are the sizes of the span_tags columns,
+	// longer keys are not indexed and longer values are truncated
+	maxTagKeyLength   = 128
+	maxTagValueLength = 255
+	// tagRowOverhead covers the span_hash, the start_time, the quotes and the separators of one span_tags row
+	tagRowOverhead = 64
+)
+
+// tagColumns are the span_tags columns written for every tag
+var tagColumns = []string{"trace_id", "span_hash", "tag_key", "tag_value", "start_time"}
+
+// columnTags are searched on their own traces column, they are not written to span_tags
+var columnTags = map[string]struct{}{
+	"http.status_code": {},
+	"error":            {},
+}
+
+// TagIndex selects the span and process tags written to span_tags so that FindTraceIDs can search them
+type TagIndex struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+// NewTagIndex indexes the keys of allow, or every key when allow is empty, except the keys of deny
+func NewTagIndex(allow []string, deny []string) *TagIndex {
+	t := &TagIndex{allow: map[string]struct{}{}, deny: map[string]struct{}{}}
+	for _, key := range allow {
+		t.allow[key] = struct{}{}
+	}
+	for _, key := range deny {
+		t.deny[key] = struct{}{}
+	}
+	return t
+}
+
+// Indexed reports whether the tag key is written to span_tags
+func (t *TagIndex) Indexed(key string) bool {
+	if _, ok := columnTags[key]; ok || len(key) > maxTagKeyLength {
+		return false
+	}
+	if _, ok := t.deny[key]; ok {
+		return false
+	}
+	if len(t.allow) == 0 {
+		return true
+	}
+	_, ok := t.allow[key]
+	return ok
+}
+
+// Tags returns the span and process tags of the span to write to span_tags
+func (t *TagIndex) Tags(span *model.Span) []dbmodel.IndexTag {
+	var tags []dbmodel.IndexTag
+	seen := map[dbmodel.IndexTag]struct{}{}
+	add := func(kvs []model.KeyValue) {
+		for _, kv := range kvs {
+			if !t.Indexed(kv.Key) {
+				continue
+			}
+			tag := dbmodel.IndexTag{Key: kv.Key, Value: truncateTagValue(kv.AsString())}
+			if _, ok := seen[tag]; !ok {
+				seen[tag] = struct{}{}
+				tags = append(tags, tag)
+			}
+		}
+	}
+	add(span.Tags)
+	if span.Process != nil {
+		add(span.Process.Tags)
+	}
+	return tags
+}
+
+// truncateTagValue cuts the value to the characters span_tags can hold, searches use the same cut
+func truncateTagValue(value string) string {
+	if len(value) <= maxTagValueLength {
+		return value
+	}
+	runes := []rune(value)
+	if len(runes) <= maxTagValueLength {
+		return value
+	}
+	return string(runes[:maxTagValueLength])
+}
+
+// indexTagsSize estimates the bytes the span_tags rows of a span take in an insert statement
+func indexTagsSize(span *dbmodel.Span) int64 {
+	var size int64
+	for _, tag := range span.IndexTags {
+		size += int64(len(span.TraceID)+len(tag.Key)+len(tag.Value)) + tagRowOverhead
+	}
+	return size
+}
+
+// hasIndexTags reports whether any of the spans has span_tags rows
+func hasIndexTags(spans []*dbmodel.Span) bool {
+	for _, span := range spans {
+		if len(span.IndexTags) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// insertTags writes the span_tags rows of the spans, the rows already there are skipped. The rows of
+// tag-heavy spans are split in several statements to stay within the placeholders of a prepared statement.
+func (b *BackgroudStore) insertTags(db dbs.Executor, spans []*dbmodel.Span) error {
+	var ib *dbs.InsertBuilder
+	rows := 0
+	flush := func() error {
+		if rows == 0 {
+			return nil
+		}
+		_, err := ib.Exec(db)
+		if err != nil {
+			b.logger.Error("insert span tags error", zap.Error(err), zap.Int("spans", len(spans)), zap.Int("tags", rows))
+		}
+		rows = 0
+		return err
+	}
+	for _, span := range spans {
+		for _, tag := range span.IndexTags {
+			if rows == 0 {
+				ib = dbs.NewInsertBuilder()
+				ib.Options("IGNORE")
+				ib.Table("span_tags")
+				ib.Columns(tagColumns...)
+			}
+			ib.Values(span.TraceID, span.SpanHash, tag.Key, tag.Value, span.StartTime)
+			rows++
+			if rows >= maxPlaceholders/len(tagColumns) {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return flush()
+}
+
+// tagCondition matches the spans with a span or process tag, like the tag columns and not any span of
+// their trace, the time range keeps the subquery on idx_tag_time
+func tagCondition(key string, value string, timeRange queryBuilder) (string, []interface{}) {
+	sub := queryBuilder{}
+	sub.where("tag_key = ?", key)
+	sub.where("tag_value = ?", truncateTagValue(value))
+	sub.conditions = append(sub.conditions, timeRange.conditions...)
+	sub.args = append(sub.args, timeRange.args...)
+	return "(trace_id, span_hash) IN (SELECT trace_id, span_hash FROM span_tags" + sub.whereClause() + ")", sub.args
+}
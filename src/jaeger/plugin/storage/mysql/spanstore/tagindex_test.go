@@ -0,0 +1,45 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTagCondition(t *testing.T) {
+	var timeRange queryBuilder
+	timeRange.where("start_time >= ?", int64(1500000000000000))
+	key, value := `user' OR '1'='1`, `x'); DROP TABLE span_tags; --`
+	condition, args := tagCondition(key, value, timeRange)
+
+	want := "(trace_id, span_hash) IN (SELECT trace_id, span_hash FROM span_tags WHERE tag_key = ? AND tag_value = ? AND start_time >= ?)"
+	if condition != want {
+		t.Errorf("condition\n got: %s\nwant: %s", condition, want)
+	}
+	wantArgs := []interface{}{key, value, int64(1500000000000000)}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args\n got: %#v\nwant: %#v", args, wantArgs)
+	}
+}
+
+func TestTagConditionTruncatesValue(t *testing.T) {
+	value := strings.Repeat("é", maxTagValueLength+10)
+	_, args := tagCondition("k", value, queryBuilder{})
+	if got := args[1].(string); got != strings.Repeat("é", maxTagValueLength) {
+		t.Errorf("value not truncated to %d runes: %d runes", maxTagValueLength, len([]rune(got)))
+	}
+}
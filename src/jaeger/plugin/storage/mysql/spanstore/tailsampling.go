@@ -0,0 +1,254 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"container/list"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uber/jaeger-lib/metrics"
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+// TailSamplingOptions describes the trace assembly buffer and the policies retaining a trace.
+// A trace with an error, a 5xx or debug span is always retained.
+type TailSamplingOptions struct {
+	// DecisionWait is how long the spans of a trace are buffered before the decision
+	DecisionWait time.Duration
+	// MaxSpans bounds the buffer, the oldest traces are decided early beyond it
+	MaxSpans int
+	// RootDuration retains the traces whose root span lasts at least that long, 0 disables the policy
+	RootDuration time.Duration
+	// Tags retains the traces with a span holding one of the tags, "key" or "key=value"
+	Tags []string
+}
+
+type TailMetrics struct {
+	keptTraceCount    metrics.Counter
+	droppedTraceCount metrics.Counter
+	// evictedTraceCount counts the traces decided before DecisionWait to keep the buffer within MaxSpans
+	evictedTraceCount metrics.Counter
+	bufferedSpans     metrics.Gauge
+	// forwardDropCount counts the spans of retained traces the queue had no room for
+	forwardDropCount metrics.Counter
+}
+
+func NewTailMetrics(keptTraceCounter metrics.Counter, droppedTraceCounter metrics.Counter, evictedTraceCounter metrics.Counter,
+	bufferedSpansGauge metrics.Gauge, forwardDropCounter metrics.Counter) TailMetrics {
+	return TailMetrics{
+		keptTraceCount:    keptTraceCounter,
+		droppedTraceCount: droppedTraceCounter,
+		evictedTraceCount: evictedTraceCounter,
+		bufferedSpans:     bufferedSpansGauge,
+		forwardDropCount:  forwardDropCounter,
+	}
+}
+
+type pendingTrace struct {
+	traceID string
+	spans   []*dbmodel.Span
+	arrival time.Time
+	element *list.Element
+}
+
+type tailDecision struct {
+	keep    bool
+	expires time.Time
+}
+
+// TailSampler groups the spans by trace for DecisionWait, then only forwards the traces retained by the policies.
+// The spans arriving after the decision of their trace follow it for another DecisionWait.
+type TailSampler struct {
+	options TailSamplingOptions
+	logger  *zap.Logger
+	TailMetrics
+	forward func(*dbmodel.Span)
+
+	lock    sync.Mutex
+	pending map[string]*pendingTrace
+	// order holds the pending traces, oldest first
+	order   *list.List
+	spans   int
+	decided map[string]tailDecision
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewTailSampler(options TailSamplingOptions, logger *zap.Logger, tailMetrics TailMetrics) *TailSampler {
+	return &TailSampler{
+		options:     options,
+		logger:      logger,
+		TailMetrics: tailMetrics,
+		pending:     map[string]*pendingTrace{},
+		order:       list.New(),
+		decided:     map[string]tailDecision{},
+		done:        make(chan struct{}),
+	}
+}
+
+// Start makes the decisions in the background, the spans of the retained traces are handed to forward
+func (t *TailSampler) Start(forward func(*dbmodel.Span)) {
+	t.forward = forward
+	t.wg.Add(1)
+	go t.run()
+}
+
+// Close decides the traces still buffered right away, the retained ones are forwarded before it returns
+func (t *TailSampler) Close() {
+	close(t.done)
+	t.wg.Wait()
+	t.lock.Lock()
+	var kept []*dbmodel.Span
+	for t.order.Len() > 0 {
+		kept = append(kept, t.settle(t.order.Front().Value.(*pendingTrace), time.Now())...)
+	}
+	t.lock.Unlock()
+	t.forwardAll(kept)
+}
+
+// Add buffers the span until its trace is decided
+func (t *TailSampler) Add(span *dbmodel.Span) {
+	now := time.Now()
+	t.lock.Lock()
+	if decision, ok := t.decided[span.TraceID]; ok {
+		t.lock.Unlock()
+		if decision.keep {
+			t.forward(span)
+		}
+		return
+	}
+	trace, ok := t.pending[span.TraceID]
+	if !ok {
+		trace = &pendingTrace{traceID: span.TraceID, arrival: now}
+		trace.element = t.order.PushBack(trace)
+		t.pending[span.TraceID] = trace
+	}
+	trace.spans = append(trace.spans, span)
+	t.spans++
+
+	var kept []*dbmodel.Span
+	for t.spans > t.options.MaxSpans && t.order.Len() > 0 {
+		t.evictedTraceCount.Inc(1)
+		kept = append(kept, t.settle(t.order.Front().Value.(*pendingTrace), now)...)
+	}
+	t.lock.Unlock()
+	t.forwardAll(kept)
+}
+
+func (t *TailSampler) run() {
+	defer t.wg.Done()
+	interval := t.options.DecisionWait / 10
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		t.lock.Lock()
+		var kept []*dbmodel.Span
+		for t.order.Len() > 0 {
+			trace := t.order.Front().Value.(*pendingTrace)
+			if now.Sub(trace.arrival) < t.options.DecisionWait {
+				break
+			}
+			kept = append(kept, t.settle(trace, now)...)
+		}
+		for traceID, decision := range t.decided {
+			if now.After(decision.expires) {
+				delete(t.decided, traceID)
+			}
+		}
+		t.bufferedSpans.Update(int64(t.spans))
+		t.lock.Unlock()
+		t.forwardAll(kept)
+	}
+}
+
+// settle removes the trace from the buffer and decides it, it returns the spans to forward. The lock must be held.
+func (t *TailSampler) settle(trace *pendingTrace, now time.Time) []*dbmodel.Span {
+	t.order.Remove(trace.element)
+	delete(t.pending, trace.traceID)
+	t.spans -= len(trace.spans)
+	keep := t.retain(trace.spans)
+	t.decided[trace.traceID] = tailDecision{keep: keep, expires: now.Add(t.options.DecisionWait)}
+	if !keep {
+		t.droppedTraceCount.Inc(1)
+		return nil
+	}
+	t.keptTraceCount.Inc(1)
+	return trace.spans
+}
+
+func (t *TailSampler) forwardAll(spans []*dbmodel.Span) {
+	for _, span := range spans {
+		t.forward(span)
+	}
+}
+
+// retain evaluates the policies on the spans of a trace
+func (t *TailSampler) retain(spans []*dbmodel.Span) bool {
+	for _, span := range spans {
+		if span.Error || span.HttpCode >= 500 || model.Flags(uint32(span.Flags)).IsDebug() {
+			return true
+		}
+		// span durations are in microseconds
+		if t.options.RootDuration > 0 && span.ParentID == 0 &&
+			span.Duration >= int64(t.options.RootDuration/time.Microsecond) {
+			return true
+		}
+		if len(t.options.Tags) > 0 && t.hasTag(span) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTag looks for the policy tags in the span tags and in the tags of its process, e.g. hostname
+func (t *TailSampler) hasTag(span *dbmodel.Span) bool {
+	var tags []model.KeyValue
+	if err := json.Unmarshal([]byte(span.Tags), &tags); err != nil {
+		t.logger.Debug("parse span tags error", zap.Error(err), zap.String("trace_id", span.TraceID))
+	}
+	var process model.Process
+	if err := json.Unmarshal([]byte(span.Process), &process); err != nil {
+		t.logger.Debug("parse span process error", zap.Error(err), zap.String("trace_id", span.TraceID))
+	}
+	tags = append(tags, process.Tags...)
+	for _, policy := range t.options.Tags {
+		key, value, withValue := policy, "", false
+		if i := strings.Index(policy, "="); i >= 0 {
+			key, value, withValue = policy[:i], policy[i+1:], true
+		}
+		for _, tag := range tags {
+			if tag.Key == key && (!withValue || tag.AsString() == value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2019 The Jaeger Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spanstore
+
+import (
+	"encoding/json"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
+)
+
+func TestTailHasTag(t *testing.T) {
+	tail := NewTailSampler(TailSamplingOptions{Tags: []string{"hostname=db-1", "canary"}}, zap.NewNop(), TailMetrics{})
+	marshal := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for _, test := range []struct {
+		name string
+		span *dbmodel.Span
+		want bool
+	}{
+		{"span tag", &dbmodel.Span{Tags: marshal([]model.KeyValue{model.Bool("canary", true)})}, true},
+		{"process tag", &dbmodel.Span{Tags: "[]", Process: marshal(model.Process{ServiceName: "db",
+			Tags: []model.KeyValue{model.String("hostname", "db-1")}})}, true},
+		{"process tag with another value", &dbmodel.Span{Tags: "[]", Process: marshal(model.Process{ServiceName: "db",
+			Tags: []model.KeyValue{model.String("hostname", "db-2")}})}, false},
+		{"unparsable span tags", &dbmodel.Span{Tags: "{", Process: marshal(model.Process{ServiceName: "db",
+			Tags: []model.KeyValue{model.String("canary", "yes")}})}, true},
+		{"no tags", &dbmodel.Span{Tags: "[]", Process: marshal(model.Process{ServiceName: "db"})}, false},
+	} {
+		if got := tail.hasTag(test.span); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
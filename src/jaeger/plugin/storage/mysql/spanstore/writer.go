@@ -16,6 +16,11 @@
 package spanstore
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"go.uber.org/zap"
 	"github.com/uber/jaeger-lib/metrics"
 
@@ -23,55 +28,266 @@ import (
 	"github.com/jaegertracing/jaeger/plugin/storage/mysql/spanstore/dbmodel"
 )
 
+const (
+	// WriteModeAsyncDrop queues the span and drops it when the queue is full
+	WriteModeAsyncDrop  = "async-drop"
+	// WriteModeAsyncBlock waits for room in the queue and fails when it stays full
+	WriteModeAsyncBlock = "async-block"
+	// WriteModeSync inserts the span before returning
+	WriteModeSync       = "sync"
+)
+
+var (
+	// ErrWriterClosed is returned by WriteSpan once the writer is closed
+	ErrWriterClosed = errors.New("mysql span writer is closed")
+	// ErrQueueFull is returned in async-block mode when the queue stayed full for the whole write timeout
+	ErrQueueFull = errors.New("mysql span queue is full")
+)
+
+// ValidateWriteMode checks mode is one of the supported write modes
+func ValidateWriteMode(mode string) error {
+	switch mode {
+	case WriteModeAsyncDrop, WriteModeAsyncBlock, WriteModeSync:
+		return nil
+	}
+	return fmt.Errorf("unknown write mode %q", mode)
+}
+
+// WriteOptions describes how WriteSpan hands the spans to mysql
+type WriteOptions struct {
+	Mode         string
+	// Timeout is how long async-block waits for room in the queue
+	Timeout      time.Duration
+	// SyncBatching groups the spans of concurrent writers into one insert in sync mode
+	SyncBatching bool
+	// FullText fills the search_text column of the spans
+	FullText     bool
+}
+
 // SpanWriter 
 type SpanWriter struct {
 	eventQueue    chan *dbmodel.Span
 	cache         *CacheStore
+	spill         *SpillQueue
+	// priority is in front of the eventQueue when not nil
+	priority      *PriorityQueue
+	// aliases renames the services to their canonical name before anything else when not nil
+	aliases       *ServiceAliases
+	// normalizer rewrites the operation names before anything else when not nil
+	normalizer    *Normalizer
+	// tagIndex selects the tags written to span_tags when not nil
+	tagIndex      *TagIndex
+	// promoted selects the tags written to their own traces column when not nil
+	promoted      *PromotedTags
+	// rateLimiter rejects the spans of the services over their limit when not nil
+	rateLimiter   *RateLimiter
+	// sampler drops a share of the spans before they are queued when not nil
+	sampler       *Sampler
+	// tail buffers the spans by trace and only queues the retained traces when not nil
+	tail          *TailSampler
+	background    *BackgroudStore
+	syncBatcher   *syncBatcher
+	options       WriteOptions
 	logger        *zap.Logger
 	WriteMetrics  
+
+	// closeLock guards eventQueue against sends after it is closed
+	closeLock     sync.RWMutex
+	closed        bool
 }
 
 type WriteMetrics struct {
 	dropSpanCount      metrics.Counter
+	// laneDropCount is indexed by lane, only used with the priority queue
+	laneDropCount      []metrics.Counter
 }
 
-func NewWriteMetrics(dropSpanCounter metrics.Counter) WriteMetrics{
+func NewWriteMetrics(dropSpanCounter metrics.Counter, laneDropCounters []metrics.Counter) WriteMetrics{
 	return WriteMetrics{
 		dropSpanCount: dropSpanCounter,
+		laneDropCount: laneDropCounters,
 	}
 }
 
-func NewSpanWriter(ch chan *dbmodel.Span, cacheStore *CacheStore, logger *zap.Logger, dropSpanCounter metrics.Counter) *SpanWriter{
-	writeMetrics := NewWriteMetrics(dropSpanCounter)
-	return &SpanWriter{
+func NewSpanWriter(ch chan *dbmodel.Span, cacheStore *CacheStore, spill *SpillQueue, priority *PriorityQueue,
+	aliases *ServiceAliases, normalizer *Normalizer, tagIndex *TagIndex, promoted *PromotedTags, rateLimiter *RateLimiter,
+	sampler *Sampler, tail *TailSampler, background *BackgroudStore, options WriteOptions, logger *zap.Logger,
+	dropSpanCounter metrics.Counter, laneDropCounters []metrics.Counter) *SpanWriter{
+	writeMetrics := NewWriteMetrics(dropSpanCounter, laneDropCounters)
+	w := &SpanWriter{
 		eventQueue: ch,
 		cache: cacheStore,
+		spill: spill,
+		priority: priority,
+		aliases: aliases,
+		normalizer: normalizer,
+		tagIndex: tagIndex,
+		promoted: promoted,
+		rateLimiter: rateLimiter,
+		sampler: sampler,
+		tail: tail,
+		background: background,
+		options: options,
 		logger: logger,
 		WriteMetrics: writeMetrics,
 	}
+	if options.Mode == WriteModeSync && options.SyncBatching {
+		w.syncBatcher = newSyncBatcher(background)
+	}
+	if tail != nil {
+		// the decisions are made in the background, nobody is waiting for the error
+		var timeout time.Duration
+		if options.Mode == WriteModeAsyncBlock {
+			timeout = options.Timeout
+		}
+		tail.Start(func(ds *dbmodel.Span) {
+			// only the retained traces reach the caches, the dropped ones must not show up in the UI
+			ds.OperationName = w.cache.UpdateCaches(ds.ServiceName, ds.OperationName, ds.SpanKind)
+			if err := w.enqueue(ds, timeout); err != nil {
+				tail.forwardDropCount.Inc(1)
+			}
+		})
+	}
+	return w
 }
 
-// Close closes SpanWriter
+// Close stops accepting spans and closes the eventQueue so the background workers can flush it,
+// the mysql client is closed by the factory once they are done
 func (w *SpanWriter) Close() error {
-	close(w.eventQueue)
-	w.cache.Close()
+	w.closeLock.Lock()
+	defer w.closeLock.Unlock()
+	if !w.closed {
+		w.closed = true
+		if w.tail != nil {
+			// the retained traces still have to be queued
+			w.tail.Close()
+		}
+		if w.priority != nil {
+			// the eventQueue is closed once the lanes are forwarded
+			w.priority.Close()
+		} else {
+			close(w.eventQueue)
+		}
+		if w.syncBatcher != nil {
+			w.syncBatcher.close()
+		}
+	}
 	return nil
 }
 
 // WriteSpan writes the given span
 func (w *SpanWriter) WriteSpan(span *model.Span) error {
+	w.closeLock.RLock()
+	defer w.closeLock.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	if w.aliases != nil {
+		span = w.aliases.Rewrite(span)
+	}
+	if w.normalizer != nil {
+		span = w.normalizer.Normalize(span)
+	}
 	ds := dbmodel.FromDomain(span)
+	if w.tagIndex != nil {
+		ds.IndexTags = w.tagIndex.Tags(span)
+	}
+	if w.promoted != nil {
+		ds.PromotedTags = w.promoted.Values(span)
+	}
+	if w.options.FullText {
+		ds.SearchText = searchText(span)
+	}
+	if w.sampler != nil && !w.sampler.Keep(ds) {
+		return nil
+	}
+	if w.rateLimiter != nil && !w.rateLimiter.Allow(ds.ServiceName, ds.OperationName) {
+		if w.options.Mode == WriteModeAsyncDrop {
+			return nil
+		}
+		return ErrRateLimited
+	}
+
+	if w.tail != nil {
+		// the caches are updated when the trace is retained
+		w.tail.Add(ds)
+		return nil
+	}
+	// the cache may rename the operation of a service with too many operations
+	ds.OperationName = w.cache.UpdateCaches(ds.ServiceName, ds.OperationName, ds.SpanKind)
+
+	var err error
+	switch {
+	case w.options.Mode == WriteModeSync:
+		err = w.writeSync(ds)
+	case w.options.Mode == WriteModeAsyncBlock:
+		err = w.enqueue(ds, w.options.Timeout)
+	default:
+		// dropped spans are only counted in async-drop mode
+		w.enqueue(ds, 0)
+	}
+
+	return err
+}
+
+// enqueue hands the span to the background workers, waiting at most timeout for room in the eventQueue.
+// When the queue stays full the span is spilled to disk if a spill queue is configured, or dropped.
+func (w *SpanWriter) enqueue(ds *dbmodel.Span, timeout time.Duration) error {
+	if w.priority != nil {
+		dropped := w.priority.Put(ds, timeout)
+		if dropped == nil {
+			return nil
+		}
+		err := w.overflow(dropped)
+		if dropped != ds {
+			// the span evicted by the overflow policy was written by someone else
+			return nil
+		}
+		return err
+	}
+
 	select {
 	case w.eventQueue <- ds:
 		w.logger.Info("sent one span")
+		return nil
 	default:
-		// report metric
-		w.logger.Error("no span sent")
-		w.dropSpanCount.Inc(1)
 	}
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case w.eventQueue <- ds:
+			w.logger.Info("sent one span")
+			return nil
+		case <-timer.C:
+		}
+	}
+	return w.overflow(ds)
+}
 
-	// use cache to save the less data, note to load the data to cache when start init 
-	w.cache.UpdateCaches(ds.ServiceName, ds.OperationName)
+// overflow spills a span the queue has no room for, or drops it
+func (w *SpanWriter) overflow(ds *dbmodel.Span) error {
+	if w.spill != nil {
+		err := w.spill.Put(ds)
+		if err == nil {
+			return nil
+		}
+		w.logger.Error("spill span error", zap.Error(err))
+	}
+	// report metric
+	w.logger.Error("no span sent")
+	w.dropSpanCount.Inc(1)
+	if w.priority != nil {
+		w.laneDropCount[spanLane(ds)].Inc(1)
+	}
+	return ErrQueueFull
+}
 
-	return nil
+// writeSync inserts the span right away and returns the mysql error
+func (w *SpanWriter) writeSync(ds *dbmodel.Span) error {
+	if w.syncBatcher != nil {
+		return w.syncBatcher.write(ds)
+	}
+	return w.background.InsertSync([]*dbmodel.Span{ds})[0]
 }